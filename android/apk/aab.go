@@ -0,0 +1,655 @@
+package repo
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/fdroidcl/adb"
+)
+
+const distNamespace = "http://schemas.android.com/apk/distribution"
+
+// isAppBundle reports whether the file at path is an Android App Bundle (.aab).
+func isAppBundle(path string) bool {
+	ok, err := zipHasFile(path, "BundleConfig.pb")
+	return err == nil && ok
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+type bundleModule struct {
+	name     string
+	manifest *axmlElement
+	// Files of the module, by their path within it
+	files     map[string]*zip.File
+	resources []*resPackage
+}
+
+// readBundleModules reads the modules of a bundle, base first.
+func readBundleModules(zr *zip.Reader) ([]*bundleModule, error) {
+	byName := make(map[string]*bundleModule)
+	for _, f := range zr.File {
+		parts := strings.SplitN(f.Name, "/", 2)
+		if len(parts) < 2 || parts[0] == "BUNDLE-METADATA" || parts[0] == "META-INF" || f.FileInfo().IsDir() {
+			continue
+		}
+
+		m, ok := byName[parts[0]]
+		if !ok {
+			m = &bundleModule{name: parts[0], files: make(map[string]*zip.File)}
+			byName[parts[0]] = m
+		}
+		m.files[parts[1]] = f
+	}
+
+	var modules []*bundleModule
+	for _, m := range byName {
+		f, ok := m.files["manifest/AndroidManifest.xml"]
+		if !ok {
+			continue
+		}
+
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if m.manifest, err = pbXML(data); err != nil {
+			return nil, fmt.Errorf("Failed to read the manifest of module %s: %s", m.name, err)
+		}
+
+		if f, ok := m.files["resources.pb"]; ok {
+			data, err := readZipFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if m.resources, err = pbResourceTable(data); err != nil {
+				return nil, fmt.Errorf("Failed to read the resources of module %s: %s", m.name, err)
+			}
+		}
+
+		modules = append(modules, m)
+	}
+
+	sort.Slice(modules, func(i, j int) bool {
+		if modules[i].name == "base" || modules[j].name == "base" {
+			return modules[i].name == "base"
+		}
+		return modules[i].name < modules[j].name
+	})
+
+	if len(modules) == 0 || modules[0].name != "base" {
+		return nil, fmt.Errorf("Bundle has no base module")
+	}
+	return modules, nil
+}
+
+// distValue is the string of a dist: attribute, which may have been compiled to a value.
+func distValue(el *axmlElement, name string) string {
+	a, ok := el.attr(distNamespace, name)
+	switch {
+	case !ok:
+		return ""
+	case a.value.dataType == typeIntBoolean:
+		return strconv.FormatBool(a.value.data != 0)
+	case a.value.dataType == typeIntDec:
+		return strconv.Itoa(int(int32(a.value.data)))
+	default:
+		return a.value.str
+	}
+}
+
+// installedAtInstallTime reports whether a module is delivered with the app to a device like
+// spec, as feature and asset modules with install-time delivery whose conditions it meets are.
+func (m *bundleModule) installedAtInstallTime(spec DeviceSpec, features func() (map[string]bool, error)) (bool, error) {
+	if m.name == "base" {
+		return true, nil
+	}
+
+	module := m.manifest.child(distNamespace, "module")
+	if module == nil {
+		return true, nil
+	}
+
+	delivery := module.child(distNamespace, "delivery")
+	if delivery == nil {
+		// As modules were marked before delivery elements
+		return distValue(module, "onDemand") != "true", nil
+	}
+
+	installTime := delivery.child(distNamespace, "install-time")
+	if installTime == nil {
+		return false, nil
+	}
+
+	conditions := installTime.child(distNamespace, "conditions")
+	if conditions == nil {
+		return true, nil
+	}
+
+	for _, condition := range conditions.children {
+		if condition.name == "" {
+			continue
+		}
+
+		switch condition.name {
+		case "min-sdk", "max-sdk":
+			sdk, err := strconv.Atoi(distValue(condition, "value"))
+			if err != nil {
+				return false, fmt.Errorf("Module %s has an invalid %s condition: %s", m.name, condition.name, err)
+			}
+			if condition.name == "min-sdk" && spec.APILevel < sdk || condition.name == "max-sdk" && spec.APILevel > sdk {
+				return false, nil
+			}
+
+		case "device-feature":
+			have, err := features()
+			if err != nil {
+				return false, err
+			}
+			if !have[distValue(condition, "name")] {
+				return false, nil
+			}
+
+		default:
+			log.Printf("[WARN] Not installing module %s, whose %s condition can't be checked", m.name, condition.name)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// deviceFeatures lists the features of the device, from `pm list features`.
+func deviceFeatures(device *adb.Device) (map[string]bool, error) {
+	stdout, err := device.AdbShell("pm", "list", "features").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list device features: %s", err)
+	}
+
+	features := make(map[string]bool)
+	for _, line := range strings.Split(string(stdout), "\n") {
+		if name := strings.TrimPrefix(strings.TrimSpace(line), "feature:"); name != strings.TrimSpace(line) {
+			features[strings.SplitN(name, "=", 2)[0]] = true
+		}
+	}
+	return features, nil
+}
+
+// bundleABI picks the device's most preferred ABI that the modules have native libraries for.
+func bundleABI(modules []*bundleModule, spec DeviceSpec) (string, error) {
+	abis := make(map[string]bool)
+	for _, m := range modules {
+		for name := range m.files {
+			if strings.HasPrefix(name, "lib/") {
+				abis[strings.Split(name, "/")[1]] = true
+			}
+		}
+	}
+
+	if len(abis) == 0 {
+		return "", nil
+	}
+
+	for _, abi := range spec.ABIs {
+		if abis[abi] {
+			return abi, nil
+		}
+	}
+
+	return "", fmt.Errorf("No native libraries for device ABIs %v", spec.ABIs)
+}
+
+// densityBucket is the name of the density that configuration splits for density are named
+// by, as SelectSplits chooses between them.
+func densityBucket(density int) string {
+	var best string
+	for name, d := range densitySplits {
+		bestD := densitySplits[best]
+		switch {
+		case best == "":
+			best = name
+		case bestD < density && d > bestD:
+			best = name
+		case d >= density && d < bestD:
+			best = name
+		}
+	}
+	return best
+}
+
+// Deprecated language codes, which the platform treats as the same language as their successors
+var languageAliases = map[string]string{
+	"iw": "he",
+	"in": "id",
+	"ji": "yi",
+	"tl": "fil",
+}
+
+func normaliseLanguage(lang string) string {
+	lang = strings.ToLower(lang)
+	if alias, ok := languageAliases[lang]; ok {
+		return alias
+	}
+	return lang
+}
+
+// deviceLanguages are the languages of the device's locales, or nil if they're unknown.
+func deviceLanguages(spec DeviceSpec) map[string]bool {
+	if len(spec.Locales) == 0 {
+		return nil
+	}
+
+	languages := make(map[string]bool)
+	for _, locale := range spec.Locales {
+		languages[normaliseLanguage(strings.SplitN(strings.ReplaceAll(locale, "_", "-"), "-", 2)[0])] = true
+	}
+	return languages
+}
+
+const (
+	bundleMaster   = "master"
+	bundleABISplit = "abi"
+	bundleDensity  = "density"
+	bundleDropped  = ""
+)
+
+// bundleBuild is the generation of a bundle's APKs for a device.
+type bundleBuild struct {
+	spec      DeviceSpec
+	abi       string
+	density   string
+	languages map[string]bool
+
+	pkg         string
+	versionCode int
+	key         *SigningKey
+	dir         string
+	paths       []string
+}
+
+// splitsOf is which of a module's APKs a resource value belongs in: the master, the density
+// split, that of its language, or none, if it's not for the device. Values for other than the
+// device's density are dropped, and the best of the rest for it split out, except mipmaps,
+// which launchers may want at any density.
+func (b *bundleBuild) splitsOf(m *bundleModule) map[*resConfigValue]string {
+	splits := make(map[*resConfigValue]string)
+	for _, pkg := range m.resources {
+		for _, t := range pkg.types {
+			for _, e := range t.entries {
+				best := make(map[string]*resConfigValue)
+				for _, cv := range e.values {
+					switch d := cv.config.density; {
+					case cv.config.language != "":
+						lang := normaliseLanguage(cv.config.language)
+						if b.languages == nil || b.languages[lang] {
+							splits[cv] = "lang:" + lang
+						} else {
+							splits[cv] = bundleDropped
+						}
+
+					case b.density == "" || t.name == "mipmap" || d == 0 || d == densityAny || d == densityNone:
+						splits[cv] = bundleMaster
+
+					default:
+						splits[cv] = bundleDropped
+						key := cv.config.withoutDensity()
+						if other, ok := best[key]; !ok || densityBetter(d, other.config.density, b.spec.Density) {
+							best[key] = cv
+						}
+					}
+				}
+
+				for _, cv := range best {
+					splits[cv] = bundleDensity
+				}
+			}
+		}
+	}
+	return splits
+}
+
+func (b *bundleBuild) write(name string, w *apkWriter) error {
+	path := filepath.Join(b.dir, name+".apk")
+	data, err := w.Sign(b.key)
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(path, data, 0o644); err != nil {
+		return err
+	}
+	b.paths = append(b.paths, path)
+	return nil
+}
+
+// buildModule generates the APKs of a module: its master, and configuration splits of its
+// native libraries for the device's ABI, and of its resources for its density and languages.
+func (b *bundleBuild) buildModule(m *bundleModule) error {
+	splits := b.splitsOf(m)
+
+	writers := map[string]*apkWriter{bundleMaster: newApkWriter()}
+	writer := func(split string) *apkWriter {
+		if writers[split] == nil {
+			writers[split] = newApkWriter()
+		}
+		return writers[split]
+	}
+	for _, split := range splits {
+		if split != bundleDropped {
+			writer(split)
+		}
+	}
+
+	// Resource files go with the values that are them, as they're opened from the same APK
+	fileSplits := make(map[string][]string)
+	protoXML := make(map[string]bool)
+	for cv, split := range splits {
+		if cv.file == "" {
+			continue
+		}
+		if split != bundleDropped {
+			fileSplits[cv.file] = append(fileSplits[cv.file], split)
+		} else if _, ok := fileSplits[cv.file]; !ok {
+			fileSplits[cv.file] = nil
+		}
+		protoXML[cv.file] = protoXML[cv.file] || cv.protoXML
+	}
+
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hasCode := false
+	for _, name := range names {
+		f := m.files[name]
+		dir := strings.SplitN(name, "/", 2)
+		if len(dir) < 2 {
+			continue
+		}
+
+		var targets []string
+		apkName, compress := dir[1], f.Method != zip.Store
+
+		switch dir[0] {
+		case "dex":
+			hasCode = true
+			targets = []string{bundleMaster}
+		case "root":
+			targets = []string{bundleMaster}
+		case "assets":
+			targets, apkName = []string{bundleMaster}, name
+		case "lib":
+			if !strings.HasPrefix(dir[1], b.abi+"/") {
+				continue
+			}
+			// Uncompressed and page-aligned, so they can be loaded directly whether or not extractNativeLibs
+			targets, apkName, compress = []string{bundleABISplit}, name, false
+		case "res":
+			var ok bool
+			if targets, ok = fileSplits[name]; !ok {
+				targets = []string{bundleMaster}
+			}
+			apkName = name
+		default:
+			continue
+		}
+		if len(targets) == 0 {
+			continue
+		}
+
+		data, err := readZipFile(f)
+		if err != nil {
+			return err
+		}
+		if protoXML[name] {
+			el, err := pbXML(data)
+			if err != nil {
+				return fmt.Errorf("Failed to read %s of module %s: %s", name, m.name, err)
+			}
+			if data, err = encodeAXML(el); err != nil {
+				return fmt.Errorf("Failed to convert %s of module %s: %s", name, m.name, err)
+			}
+			compress = true
+		}
+
+		added := make(map[string]bool)
+		for _, split := range targets {
+			if added[split] {
+				continue
+			}
+			added[split] = true
+
+			if err = writer(split).add(apkName, data, compress); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Named as bundletool's, e.g. base-master.apk, base-arm64_v8a.apk, feature-xxhdpi.apk, base-fr.apk
+	suffixes := map[string]string{bundleMaster: "master", bundleDensity: b.density, bundleABISplit: strings.ReplaceAll(b.abi, "-", "_")}
+
+	var order []string
+	for split := range writers {
+		if strings.HasPrefix(split, "lang:") {
+			suffixes[split] = strings.TrimPrefix(split, "lang:")
+		}
+		order = append(order, split)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		// The master first
+		if order[i] == bundleMaster || order[j] == bundleMaster {
+			return order[i] == bundleMaster
+		}
+		return suffixes[order[i]] < suffixes[order[j]]
+	})
+
+	for _, split := range order {
+		w := writers[split]
+
+		table, err := encodeArsc(m.resources, func(cv *resConfigValue) bool { return splits[cv] == split })
+		if err != nil {
+			return fmt.Errorf("Failed to convert the resources of module %s: %s", m.name, err)
+		}
+		if table != nil {
+			if err = w.add("resources.arsc", table, false); err != nil {
+				return err
+			}
+		}
+
+		var manifest []byte
+		switch {
+		case split == bundleMaster:
+			manifest, err = b.masterManifest(m, hasCode)
+		case m.name == "base":
+			manifest, err = splitManifestXML(b.pkg, b.versionCode, "config."+suffixes[split], "")
+		default:
+			manifest, err = splitManifestXML(b.pkg, b.versionCode, m.name+".config."+suffixes[split], m.name)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to convert the manifest of module %s: %s", m.name, err)
+		}
+		if err = w.add("AndroidManifest.xml", manifest, true); err != nil {
+			return err
+		}
+
+		if err = b.write(fmt.Sprintf("%s-%s", m.name, suffixes[split]), w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// masterManifest is the module's manifest, as a feature split's if it's not the base.
+func (b *bundleBuild) masterManifest(m *bundleModule, hasCode bool) ([]byte, error) {
+	manifest := m.manifest
+	if m.name != "base" {
+		manifest.setAttr(axmlString("package", b.pkg))
+		manifest.setAttr(axmlString("split", m.name))
+		manifest.setAttr(axmlAndroidInt(0x0101021b, "versionCode", b.versionCode))
+		manifest.setAttr(axmlAndroidBool(0x0101055b, "isFeatureSplit", true))
+
+		if !hasCode {
+			application := manifest.child("", "application")
+			if application == nil {
+				application = &axmlElement{name: "application"}
+				manifest.children = append(manifest.children, application)
+			}
+			application.setAttr(axmlAndroidBool(0x0101000c, "hasCode", false))
+		}
+	}
+
+	return encodeAXML(manifest)
+}
+
+// bundleSource identifies the APKs built from the bundle of the given SHA-256 for a device, and
+// signed by key, by which they're cached; they can be found by it without the bundle.
+func bundleSource(bundleSum []byte, spec DeviceSpec, features map[string]bool, key *SigningKey) string {
+	var names []string
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	config := sha256.Sum256([]byte(fmt.Sprintf("%v\n%d\n%v\n%d\n%v", spec.ABIs, spec.Density, spec.Locales, spec.APILevel, names)))
+	return fmt.Sprintf("aab:%x-%s-%x", bundleSum, certFingerprint(key.Cert)[:16], config[:8])
+}
+
+// cachedBundleApks returns the APKs built from the bundle of the given SHA-256 for device and
+// signed by key, if they're cached.
+func cachedBundleApks(bundleSum []byte, device *adb.Device, key *SigningKey) ([]string, bool, error) {
+	props, err := device.AdbProps()
+	if err != nil {
+		return nil, false, err
+	}
+
+	features, err := deviceFeatures(device)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return cachedBySource(bundleSource(bundleSum, DeviceSpecFromProps(props), features, key))
+}
+
+// buildBundleApks generates the split APKs of an Android App Bundle for device, like `bundletool
+// build-apks --connected-device`: those of the base module, and of the feature and asset modules
+// it would have installed with it. Each has a master APK, and configuration splits of native
+// libraries for the device's ABI, and of resources for its density and each of its languages
+// (or all languages, if the device's are unknown). Assets aren't split by language or texture
+// compression format. They're cached, bounded by limits.
+func buildBundleApks(bundlePath string, device *adb.Device, key *SigningKey, limits CacheLimits) ([]string, error) {
+	if key == nil {
+		return nil, fmt.Errorf("A signing key is required to build APKs from %s", bundlePath)
+	}
+
+	if device == nil {
+		return nil, fmt.Errorf("A device is required to build APKs from %s", bundlePath)
+	}
+
+	props, err := device.AdbProps()
+	if err != nil {
+		return nil, err
+	}
+	spec := DeviceSpecFromProps(props)
+
+	features, err := deviceFeatures(device)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := ioutil.ReadFile(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleSum := sha256.Sum256(bundle)
+	source := bundleSource(bundleSum[:], spec, features, key)
+	if paths, ok, err := cachedBySource(source); err != nil || ok {
+		return paths, err
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		return nil, err
+	}
+
+	allModules, err := readBundleModules(zr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %s", bundlePath, err)
+	}
+
+	var modules []*bundleModule
+	var moduleNames []string
+	for _, m := range allModules {
+		ok, err := m.installedAtInstallTime(spec, func() (map[string]bool, error) { return features, nil })
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Printf("[INFO] Not installing module %s of %s, which isn't delivered at install time to the device", m.name, bundlePath)
+			continue
+		}
+		modules = append(modules, m)
+		moduleNames = append(moduleNames, m.name)
+	}
+
+	b := &bundleBuild{spec: spec, languages: deviceLanguages(spec), key: key}
+
+	if b.abi, err = bundleABI(modules, spec); err != nil {
+		return nil, err
+	}
+
+	if spec.Density == 0 {
+		log.Println("[WARN] Device density unknown, keeping resources of all densities")
+	} else {
+		b.density = densityBucket(spec.Density)
+	}
+
+	var languages []string
+	for lang := range b.languages {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+
+	base := modules[0].manifest
+	pkgAttr, _ := base.attr("", "package")
+	versionCode, ok := base.attr(axmlNamespace, "versionCode")
+	if pkgAttr.value.str == "" || !ok {
+		return nil, fmt.Errorf("The manifest of %s has no package or versionCode", bundlePath)
+	}
+	b.pkg, b.versionCode = pkgAttr.value.str, int(int32(versionCode.value.data))
+
+	if b.dir, err = cacheStagingDir(); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(b.dir)
+
+	for _, m := range modules {
+		if err = b.buildModule(m); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("[INFO] Built %s from %s, modules %v, for %s %s %v", b.pkg, bundlePath, moduleNames, b.abi, b.density, languages)
+	return cacheStore(b.paths, source, limits)
+}
@@ -0,0 +1,392 @@
+package repo
+
+import (
+	"fmt"
+	"log"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Decoding of the protobuf formats in which bundles hold resources and XML, those of aapt2's
+// Resources.proto and Configuration.proto, into what's encoded in APKs.
+
+// Fields of Resources.proto's Item
+const (
+	pbItemRef       = 1
+	pbItemStr       = 2
+	pbItemRawStr    = 3
+	pbItemStyledStr = 4
+	pbItemFile      = 5
+	pbItemID        = 6
+	pbItemPrim      = 7
+
+	pbFileProtoXML = 3
+)
+
+// Res_value types of Primitive's fields, by field number
+var pbPrimitiveTypes = map[protowire.Number]uint8{
+	3:  typeFloat,
+	4:  typeDimension, // deprecated, as a float
+	5:  typeFraction,  // deprecated, as a float
+	6:  typeIntDec,
+	7:  typeIntHex,
+	8:  typeIntBoolean,
+	9:  typeIntColorARGB8,
+	10: typeIntColorRGB8,
+	11: typeIntColorARGB4,
+	12: typeIntColorRGB4,
+	13: typeDimension,
+	14: typeFraction,
+}
+
+// pbReference decodes a Reference as its Res_value.
+func pbReference(ref pbMessage) resValue {
+	dynamic := false
+	if isDynamic, ok := ref.message(5); ok {
+		dynamic = isDynamic.uint(1) != 0
+	}
+
+	id := uint32(ref.uint(2))
+	v := resValue{data: id}
+	switch {
+	case ref.uint(1) == 1 && dynamic && id != 0:
+		v.dataType = typeDynamicAttr
+	case ref.uint(1) == 1:
+		v.dataType = typeAttribute
+	case dynamic && id != 0:
+		v.dataType = typeDynamicRef
+	default:
+		v.dataType = typeReference
+	}
+	return v
+}
+
+// pbItem decodes an Item as its Res_value, and the file it refers to, if any.
+func pbItem(item pbMessage) (resValue, pbMessage, error) {
+	switch {
+	case item.has(pbItemRef):
+		ref, _ := item.message(pbItemRef)
+		return pbReference(ref), pbMessage{}, nil
+
+	case item.has(pbItemStr), item.has(pbItemRawStr):
+		num := protowire.Number(pbItemStr)
+		if !item.has(num) {
+			num = pbItemRawStr
+		}
+		str, _ := item.message(num)
+		return resValue{dataType: typeString, str: str.str(1)}, pbMessage{}, nil
+
+	case item.has(pbItemStyledStr):
+		styled, _ := item.message(pbItemStyledStr)
+		v := resValue{dataType: typeString, str: styled.str(1)}
+		for _, span := range styled.messages(2) {
+			v.spans = append(v.spans, stringSpan{tag: span.str(1), first: uint32(span.uint(2)), last: uint32(span.uint(3))})
+		}
+		return v, pbMessage{}, nil
+
+	case item.has(pbItemFile):
+		file, _ := item.message(pbItemFile)
+		return resValue{dataType: typeString, str: file.str(1)}, file, nil
+
+	case item.has(pbItemID):
+		return resValue{dataType: typeIntBoolean}, pbMessage{}, nil
+
+	case item.has(pbItemPrim):
+		prim, _ := item.message(pbItemPrim)
+		switch {
+		case prim.has(1):
+			return resValue{dataType: typeNull}, pbMessage{}, nil
+		case prim.has(2):
+			return resValue{dataType: typeNull, data: resValueNullEmpty}, pbMessage{}, nil
+		}
+
+		for num, dataType := range pbPrimitiveTypes {
+			if !prim.has(num) {
+				continue
+			}
+
+			v := resValue{dataType: dataType}
+			switch {
+			case len(prim.fixed32s[num]) > 0:
+				v.data = prim.fixed32(num)
+			case dataType == typeIntBoolean && prim.uint(num) != 0:
+				v.data = 0xffffffff
+			default:
+				v.data = uint32(prim.uint(num))
+			}
+			return v, pbMessage{}, nil
+		}
+	}
+
+	return resValue{}, pbMessage{}, fmt.Errorf("Unsupported resource value")
+}
+
+// pbXML decodes an XmlNode.
+func pbXML(data []byte) (*axmlElement, error) {
+	node, err := parsePB(data)
+	if err != nil {
+		return nil, err
+	}
+	return pbXMLNode(node)
+}
+
+func pbXMLNode(node pbMessage) (*axmlElement, error) {
+	var line uint32
+	if source, ok := node.message(3); ok {
+		line = uint32(source.uint(1))
+	}
+
+	element, ok := node.message(1)
+	if !ok {
+		return &axmlElement{text: node.str(2), line: line}, nil
+	}
+
+	el := &axmlElement{
+		ns:   element.str(2),
+		name: element.str(3),
+		line: line,
+	}
+
+	for _, ns := range element.messages(1) {
+		el.namespaces = append(el.namespaces, axmlNamespaceDecl{prefix: ns.str(1), uri: ns.str(2)})
+	}
+
+	for _, attr := range element.messages(4) {
+		a := axmlAttr{
+			ns:    attr.str(1),
+			name:  attr.str(2),
+			resID: uint32(attr.uint(5)),
+			value: resValue{dataType: typeString, str: attr.str(3)},
+		}
+
+		if item, ok := attr.message(6); ok {
+			v, _, err := pbItem(item)
+			if err != nil {
+				return nil, fmt.Errorf("Attribute %s: %s", a.name, err)
+			}
+			a.value = v
+		}
+
+		el.attrs = append(el.attrs, a)
+	}
+
+	for _, child := range element.messages(5) {
+		c, err := pbXMLNode(child)
+		if err != nil {
+			return nil, err
+		}
+		el.children = append(el.children, c)
+	}
+
+	return el, nil
+}
+
+// pbConfig decodes a Configuration as the ResTable_config its enums are offsets into.
+func pbConfig(config pbMessage) resConfig {
+	c := resConfig{
+		mcc:                   uint16(config.uint(1)),
+		mnc:                   uint16(config.uint(2)),
+		screenWidth:           uint16(config.uint(5)),
+		screenHeight:          uint16(config.uint(6)),
+		screenWidthDp:         uint16(config.uint(7)),
+		screenHeightDp:        uint16(config.uint(8)),
+		smallestScreenWidthDp: uint16(config.uint(9)),
+		orientation:           uint8(config.uint(15)),
+		density:               uint16(config.uint(18)),
+		touchscreen:           uint8(config.uint(19)),
+		keyboard:              uint8(config.uint(21)),
+		navigation:            uint8(config.uint(23)),
+		sdkVersion:            uint16(config.uint(24)),
+		grammaticalInflection: uint8(config.uint(26)),
+	}
+
+	if locale := config.str(3); locale != "" {
+		c.setLocale(locale)
+	}
+
+	// The yes/no enums are yes first, where the platform's are no first
+	yesNo := func(v uint64, shift uint) uint8 {
+		switch v {
+		case 1:
+			return 2 << shift
+		case 2:
+			return 1 << shift
+		}
+		return 0
+	}
+
+	c.screenLayout = uint8(config.uint(4))<<6 | uint8(config.uint(10)) | yesNo(config.uint(11), 4)
+	c.screenLayout2 = yesNo(config.uint(12), 0)
+	c.colorMode = yesNo(config.uint(13), 0) | yesNo(config.uint(14), 2)
+	c.uiMode = uint8(config.uint(16)) | yesNo(config.uint(17), 4)
+	c.inputFlags = uint8(config.uint(20)) | uint8(config.uint(22))<<2
+
+	return c
+}
+
+// pbResourceTable decodes a module's ResourceTable.
+func pbResourceTable(data []byte) ([]*resPackage, error) {
+	table, err := parsePB(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []*resPackage
+	for _, pkgMsg := range table.messages(2) {
+		pkgID, ok := pkgMsg.message(1)
+		if !ok {
+			return nil, fmt.Errorf("Resource package %s has no ID", pkgMsg.str(2))
+		}
+		pkg := &resPackage{id: uint32(pkgID.uint(1)), name: pkgMsg.str(2)}
+
+		for _, typeMsg := range pkgMsg.messages(3) {
+			typeID, ok := typeMsg.message(1)
+			name := typeMsg.str(2)
+			// Styleables and macros are only of R, not the table
+			if !ok || name == "styleable" || name == "macro" {
+				continue
+			}
+			t := &resType{id: uint32(typeID.uint(1)), name: name}
+			if t.id == 0 {
+				return nil, fmt.Errorf("Resource type %s has no ID", name)
+			}
+
+			for _, entryMsg := range typeMsg.messages(3) {
+				entryID, ok := entryMsg.message(1)
+				if !ok {
+					log.Printf("[WARN] Skipping resource %s/%s, which has no ID", name, entryMsg.str(2))
+					continue
+				}
+				e := &resEntry{id: uint32(entryID.uint(1)), name: entryMsg.str(2)}
+				if visibility, ok := entryMsg.message(3); ok {
+					e.public = visibility.uint(1) == 2
+				}
+
+				for _, configValue := range entryMsg.messages(6) {
+					config, _ := configValue.message(1)
+					value, ok := configValue.message(2)
+					if !ok {
+						continue
+					}
+
+					cv, err := pbValue(value)
+					if err != nil {
+						return nil, fmt.Errorf("Resource %s/%s: %s", name, e.name, err)
+					}
+					if cv == nil {
+						continue
+					}
+					cv.config = pbConfig(config)
+					e.values = append(e.values, cv)
+				}
+
+				t.entries = append(t.entries, e)
+			}
+
+			pkg.types = append(pkg.types, t)
+		}
+
+		packages = append(packages, pkg)
+	}
+
+	return packages, nil
+}
+
+// Map names of Plural's arities, zero first and other last
+var pbPluralArities = []uint32{resMapAttrZero, resMapAttrZero + 1, resMapAttrZero + 2, resMapAttrZero + 3, resMapAttrZero + 4, resMapAttrOther}
+
+// pbValue decodes a Value, or returns nil if it's not one that's in the table.
+func pbValue(value pbMessage) (*resConfigValue, error) {
+	cv := &resConfigValue{weak: value.uint(3) != 0}
+
+	if item, ok := value.message(4); ok {
+		v, file, err := pbItem(item)
+		if err != nil {
+			return nil, err
+		}
+		cv.value = v
+		if file.has(1) {
+			cv.file = file.str(1)
+			cv.protoXML = file.uint(2) == pbFileProtoXML
+		}
+		return cv, nil
+	}
+
+	compound, ok := value.message(5)
+	if !ok {
+		return nil, fmt.Errorf("Value has neither an item nor a compound value")
+	}
+	cv.complex = true
+
+	mapItem := func(name uint32, item pbMessage) error {
+		v, _, err := pbItem(item)
+		if err != nil {
+			return err
+		}
+		cv.maps = append(cv.maps, resMap{name: name, value: v})
+		return nil
+	}
+
+	switch {
+	case compound.has(1):
+		attr, _ := compound.message(1)
+		cv.maps = append(cv.maps, resMap{name: resMapAttrType, value: resValue{dataType: typeIntDec, data: uint32(attr.uint(1))}})
+		if min := int32(attr.uint(2)); min != math.MinInt32 {
+			cv.maps = append(cv.maps, resMap{name: resMapAttrMin, value: resValue{dataType: typeIntDec, data: uint32(min)}})
+		}
+		if max := int32(attr.uint(3)); max != math.MaxInt32 {
+			cv.maps = append(cv.maps, resMap{name: resMapAttrMax, value: resValue{dataType: typeIntDec, data: uint32(max)}})
+		}
+		for _, symbol := range attr.messages(4) {
+			name, _ := symbol.message(3)
+			dataType := uint8(symbol.uint(5))
+			if dataType == typeNull {
+				dataType = typeIntDec
+			}
+			cv.maps = append(cv.maps, resMap{name: uint32(name.uint(2)), value: resValue{dataType: dataType, data: uint32(symbol.uint(4))}})
+		}
+
+	case compound.has(2):
+		style, _ := compound.message(2)
+		if parent, ok := style.message(1); ok {
+			cv.parent = uint32(parent.uint(2))
+		}
+		for _, entry := range style.messages(3) {
+			key, _ := entry.message(3)
+			item, _ := entry.message(4)
+			if err := mapItem(uint32(key.uint(2)), item); err != nil {
+				return nil, err
+			}
+		}
+		sortMaps(cv.maps)
+
+	case compound.has(4):
+		array, _ := compound.message(4)
+		for i, element := range array.messages(1) {
+			item, _ := element.message(3)
+			if err := mapItem(resMapArray|uint32(i), item); err != nil {
+				return nil, err
+			}
+		}
+
+	case compound.has(5):
+		plural, _ := compound.message(5)
+		for _, entry := range plural.messages(1) {
+			arity := entry.uint(3)
+			if arity >= uint64(len(pbPluralArities)) {
+				return nil, fmt.Errorf("Unknown plural arity %d", arity)
+			}
+			item, _ := entry.message(4)
+			if err := mapItem(pbPluralArities[arity], item); err != nil {
+				return nil, err
+			}
+		}
+
+	default:
+		// Styleables and macros
+		return nil, nil
+	}
+
+	return cv, nil
+}
@@ -0,0 +1,350 @@
+package repo
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shogo82148/androidbinary"
+	"google.golang.org/protobuf/encoding/protowire"
+	"mvdan.cc/fdroidcl/adb"
+)
+
+func pbTestMessage(num protowire.Number, fields ...[]byte) []byte {
+	return protowire.AppendBytes(protowire.AppendTag(nil, num, protowire.BytesType), bytes.Join(fields, nil))
+}
+
+func pbTestString(num protowire.Number, s string) []byte {
+	return protowire.AppendString(protowire.AppendTag(nil, num, protowire.BytesType), s)
+}
+
+func pbTestVarint(num protowire.Number, v uint64) []byte {
+	return protowire.AppendVarint(protowire.AppendTag(nil, num, protowire.VarintType), v)
+}
+
+// pbTestElement is an XmlNode of an element, with attributes of (namespace, name, Item).
+func pbTestElement(ns string, name string, attrs [][3]interface{}, children ...[]byte) []byte {
+	fields := [][]byte{
+		pbTestMessage(1, pbTestString(1, "android"), pbTestString(2, axmlNamespace)),
+		pbTestString(2, ns),
+		pbTestString(3, name),
+	}
+	for _, a := range attrs {
+		attr := [][]byte{pbTestString(1, a[0].(string)), pbTestString(2, a[1].(string))}
+		if item, ok := a[2].([]byte); ok {
+			attr = append(attr, pbTestMessage(6, item))
+		} else {
+			attr = append(attr, pbTestString(3, a[2].(string)))
+		}
+		fields = append(fields, pbTestMessage(4, attr...))
+	}
+	for _, c := range children {
+		fields = append(fields, pbTestMessage(5, c))
+	}
+	return pbTestMessage(1, fields...)
+}
+
+// pbTestValue is a ConfigValue of an Item, for a config of locale and density.
+func pbTestValue(locale string, density uint64, item []byte) []byte {
+	return pbTestMessage(6,
+		pbTestMessage(1, pbTestString(3, locale), pbTestVarint(18, density)),
+		pbTestMessage(2, pbTestMessage(4, item)),
+	)
+}
+
+func pbTestEntry(id uint64, name string, values ...[]byte) []byte {
+	return pbTestMessage(3, append([][]byte{pbTestMessage(1, pbTestVarint(1, id)), pbTestString(2, name)}, values...)...)
+}
+
+func pbTestType(id uint64, name string, entries ...[]byte) []byte {
+	return pbTestMessage(3, append([][]byte{pbTestMessage(1, pbTestVarint(1, id)), pbTestString(2, name)}, entries...)...)
+}
+
+func testBundle(t *testing.T) *zip.Reader {
+	data := testBundleData(t)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr
+}
+
+// testBundleData is an App Bundle of org.example.app @ 42, with an on-demand module.
+func testBundleData(t *testing.T) []byte {
+	str := func(s string) []byte { return pbTestMessage(2, pbTestString(1, s)) }
+	file := func(path string) []byte { return pbTestMessage(5, pbTestString(1, path), pbTestVarint(2, 1)) }
+
+	manifest := pbTestElement("", "manifest", [][3]interface{}{
+		{"", "package", "org.example.app"},
+		{axmlNamespace, "versionCode", pbTestMessage(7, pbTestVarint(6, 42))},
+	}, pbTestElement("", "application", [][3]interface{}{
+		{axmlNamespace, "label", pbTestMessage(1, pbTestVarint(2, 0x7f010000))},
+	}))
+
+	resources := pbTestMessage(2,
+		pbTestMessage(1, pbTestVarint(1, 0x7f)),
+		pbTestString(2, "org.example.app"),
+		pbTestType(1, "string", pbTestEntry(0, "app_name",
+			pbTestValue("", 0, str("App")),
+			pbTestValue("fr", 0, str("Appli")),
+			pbTestValue("de-DE", 0, str("Anwendung")),
+		)),
+		pbTestType(2, "drawable", pbTestEntry(0, "icon",
+			pbTestValue("", 160, file("res/drawable-mdpi-v4/icon.png")),
+			pbTestValue("", 320, file("res/drawable-xhdpi-v4/icon.png")),
+			pbTestValue("", 480, file("res/drawable-xxhdpi-v4/icon.png")),
+		)),
+	)
+
+	onDemand := pbTestElement("", "manifest", [][3]interface{}{{"", "package", "org.example.app"}},
+		pbTestElement(distNamespace, "module", nil,
+			pbTestElement(distNamespace, "delivery", nil,
+				pbTestElement(distNamespace, "on-demand", nil))))
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string][]byte{
+		"BundleConfig.pb":                           nil,
+		"base/manifest/AndroidManifest.xml":         manifest,
+		"base/resources.pb":                         resources,
+		"base/dex/classes.dex":                      []byte("dex"),
+		"base/lib/arm64-v8a/libapp.so":              []byte("arm64"),
+		"base/lib/x86_64/libapp.so":                 []byte("x86_64"),
+		"base/res/drawable-mdpi-v4/icon.png":        []byte("mdpi"),
+		"base/res/drawable-xhdpi-v4/icon.png":       []byte("xhdpi"),
+		"base/res/drawable-xxhdpi-v4/icon.png":      []byte("xxhdpi"),
+		"ondemand/manifest/AndroidManifest.xml":     onDemand,
+		"ondemand/dex/classes.dex":                  []byte("ondemand"),
+		"BUNDLE-METADATA/com.android.tools/mapping": nil,
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// useTestAdb puts a stand-in for adb on PATH, for the rest of the test, as a device with
+// testSplitApks' configuration. It runs script for commands it doesn't know.
+func useTestAdb(t *testing.T, script string) *adb.Device {
+	if runtime.GOOS == "windows" {
+		t.Skip("adb is stood in for by a shell script")
+	}
+
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "adb"), []byte(`#!/bin/sh
+shift 2 # -s <serial>
+case "$*" in
+"shell getprop")
+	printf '%s\n' '[ro.product.cpu.abilist]: [arm64-v8a]' '[ro.sf.lcd_density]: [440]' '[persist.sys.locale]: [fr-FR]' '[ro.build.version.sdk]: [30]'
+	;;
+"shell pm list features")
+	echo feature:android.hardware.touchscreen
+	;;
+*)
+	`+script+`
+	;;
+esac
+`), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+
+	return &adb.Device{ID: "test"}
+}
+
+func testSigningKey(t *testing.T) *SigningKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SigningKey{key, cert}
+}
+
+// testSplitApks builds the base module of testBundle for an arm64 xxhdpi French device, signed
+// by key, as the contents of APKs named as Google Play names them: "base", and "config.<split>".
+func testSplitApks(t *testing.T, key *SigningKey) map[string][]byte {
+	modules, err := readBundleModules(testBundle(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := DeviceSpec{ABIs: []string{"arm64-v8a"}, Density: 440, Locales: []string{"fr-FR"}, APILevel: 30}
+	b := &bundleBuild{
+		spec:        spec,
+		abi:         "arm64-v8a",
+		density:     densityBucket(spec.Density),
+		languages:   deviceLanguages(spec),
+		pkg:         "org.example.app",
+		versionCode: 42,
+		key:         key,
+		dir:         t.TempDir(),
+	}
+	if err = b.buildModule(modules[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	apks := make(map[string][]byte)
+	for _, path := range b.paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "base-"), ".apk")
+		if name == "master" {
+			name = "base"
+		} else {
+			name = "config." + name
+		}
+
+		if apks[name], err = ioutil.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return apks
+}
+
+func TestBuildBundleModule(t *testing.T) {
+	modules, err := readBundleModules(testBundle(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(modules) != 2 || modules[0].name != "base" {
+		t.Fatalf("Read modules %v, want base and ondemand", modules)
+	}
+
+	spec := DeviceSpec{ABIs: []string{"arm64-v8a"}, Density: 440, Locales: []string{"fr-FR"}, APILevel: 30}
+	if ok, err := modules[1].installedAtInstallTime(spec, nil); ok || err != nil {
+		t.Errorf("On-demand module installed at install time: %v, %v", ok, err)
+	}
+
+	b := &bundleBuild{
+		spec:        spec,
+		abi:         "arm64-v8a",
+		density:     densityBucket(spec.Density),
+		languages:   deviceLanguages(spec),
+		pkg:         "org.example.app",
+		versionCode: 42,
+		key:         testSigningKey(t),
+		dir:         t.TempDir(),
+	}
+	if err = b.buildModule(modules[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The files of each APK, and the value of each resource from its table
+	want := map[string][]string{
+		"base-master.apk":    {"@0x7F010000=App", "AndroidManifest.xml", "classes.dex", "resources.arsc"},
+		"base-arm64_v8a.apk": {"AndroidManifest.xml", "lib/arm64-v8a/libapp.so"},
+		"base-xxhdpi.apk":    {"@0x7F020000=res/drawable-xxhdpi-v4/icon.png", "AndroidManifest.xml", "res/drawable-xxhdpi-v4/icon.png", "resources.arsc"},
+		"base-fr.apk":        {"@0x7F010000=Appli", "AndroidManifest.xml", "resources.arsc"},
+	}
+
+	if len(b.paths) != len(want) {
+		t.Errorf("Built %v, want %d APKs", b.paths, len(want))
+	}
+
+	for _, path := range b.paths {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+
+		var got []string
+		var table *androidbinary.TableFile
+		for _, f := range zr.File {
+			if filepath.Dir(f.Name) == "META-INF" {
+				continue
+			}
+			got = append(got, f.Name)
+
+			data, err := readZipFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			switch f.Name {
+			case "AndroidManifest.xml":
+				var m struct {
+					Package     string              `xml:"package,attr"`
+					VersionCode androidbinary.Int32 `xml:"http://schemas.android.com/apk/res/android versionCode,attr"`
+				}
+				xml, err := androidbinary.NewXMLFile(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("%s: %s", path, err)
+				}
+				if err = xml.Decode(&m, nil, nil); err != nil {
+					t.Fatalf("%s: %s", path, err)
+				}
+				if vc, _ := m.VersionCode.Int32(); m.Package != "org.example.app" || vc != 42 {
+					t.Errorf("%s manifest is of %s @ %d", path, m.Package, vc)
+				}
+			case "resources.arsc":
+				if table, err = androidbinary.NewTableFile(bytes.NewReader(data)); err != nil {
+					t.Fatalf("%s: %s", path, err)
+				}
+			}
+		}
+
+		if table != nil {
+			for _, id := range []androidbinary.ResID{0x7f010000, 0x7f020000} {
+				if v, err := table.GetResource(id, nil); err == nil {
+					got = append(got, id.String()+"="+v.(string))
+				}
+			}
+		}
+
+		sort.Strings(got)
+		name := filepath.Base(path)
+		if wantFiles := want[name]; !equalStrings(got, wantFiles) {
+			t.Errorf("%s has %v, want %v", name, got, wantFiles)
+		}
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -5,6 +5,8 @@ import (
 	aapt "github.com/shogo82148/androidbinary/apk"
 	"log"
 	"mvdan.cc/fdroidcl/adb"
+	"sort"
+	"time"
 )
 
 type APKAcquirer interface {
@@ -14,27 +16,123 @@ type APKAcquirer interface {
 }
 
 type Apk struct {
-	Name     string
-	BasePath *string
-	Paths    []string
+	Name          string
+	VersionFilter *VersionFilter
+	Signers       []string
+	BasePath      *string
+	Paths         []string
+	// Of the methods given to Package, that which acquired the APKs
+	Method string
+	// Of the APKs planned to be installed, if known, as in Metadata: which of several builds of the
+	// version to install is picked by these
+	PlannedSha256 string
+	PlannedSigner string
+	// As in Options, shared by all methods of acquiring the package
+	Offline     bool
+	CacheLimits CacheLimits
 }
 
-func Package(method string, pkg string) (APKAcquirer, error) {
-	apk := Apk{Name: pkg}
-	var acq APKAcquirer
-
-	switch method {
-	case "aurora":
-		acq = AuroraPackage{&apk}
-	case "fdroid":
-		acq = FDroidPackage{&apk}
-	case "gplaycli":
-		acq = GPlayCLIPackage{&apk}
-	default:
-		return nil, fmt.Errorf("Unknown APKAcquirer method: %s", method)
+// Options holds the method-specific configuration of an APKAcquirer.
+type Options struct {
+	// Path to an APK, App Bundle, a directory of split APKs, or a glob (method "local")
+	Path string
+	// URL of an APK, App Bundle, or zip of split APKs (method "url")
+	URL string
+	// Hex-encoded SHA-256 that the download from URL must match
+	Sha256 string
+	// Repositories to search in order (method "fdroid"), defaults to DefaultFDroidRepo
+	FDroidRepos []FDroidRepo
+	// Indices loaded so far by this run, shared by all FDroidPackages (method "fdroid")
+	FDroidIndices *FDroidIndices
+	// Exact versionCode to install, rather than the suggested version (method "fdroid")
+	VersionCode int
+	// Restricts the versions that may be picked, see CheckVersion
+	VersionFilter *VersionFilter
+	// SHA-256 fingerprints of the certificates the APKs may be signed by, see CheckSigner
+	Signers []string
+	// Reference device to copy the installed package from (method "device")
+	SourceDevice *adb.Device
+	// Key to sign the APKs built from an App Bundle with (methods "local" and "url")
+	BundleSigningKey *SigningKey
+	// Google Play account and device to download as (method "gplaycli")
+	GPlay *GPlayConfig
+	// Program and arguments that acquire the APKs (method "exec"), see ExecPackage
+	Command []string
+	// Method to try first if there are several, e.g. that which the version to install was planned from
+	PreferredMethod string
+	// Hex-encoded SHA-256 and signer of the APKs planned to be installed, see Apk
+	PlannedSha256 string
+	PlannedSigner string
+	// Acquire the APKs only from the cache (and F-Droid indices as last downloaded), for sites
+	// without internet access at which the cache was seeded beforehand
+	Offline bool
+	// Bounds of the APK cache, enforced as APKs are added to it
+	CacheLimits CacheLimits
+	// Time since a source was last checked for updates within which it isn't again, see RefreshedPackage
+	RefreshInterval time.Duration
+	// Time Command may run for, zero for no limit (method "exec")
+	ExecTimeout time.Duration
+	// Bounds of waiting on AuroraStore (method "aurora")
+	AuroraTimeouts AuroraTimeouts
+}
+
+// A Method makes the APKAcquirer of apk, from the Options that are relevant to it.
+type Method func(apk *Apk, opts Options) APKAcquirer
+
+var methods = make(map[string]Method)
+
+// RegisterMethod makes a method of acquiring APKs available to Package by name.
+func RegisterMethod(name string, method Method) {
+	if _, ok := methods[name]; ok {
+		panic(fmt.Sprintf("APKAcquirer method %s registered twice", name))
+	}
+	methods[name] = method
+}
+
+// Methods lists the names of the registered methods.
+func Methods() []string {
+	var names []string
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Package returns the APKAcquirer of pkg by the named methods, which if there are several are
+// tried in order, see FallbackPackage.
+func Package(names []string, pkg string, opts Options) (APKAcquirer, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No APKAcquirer method for %s", pkg)
+	}
+
+	apk := &Apk{
+		Name:          pkg,
+		VersionFilter: opts.VersionFilter,
+		Signers:       opts.Signers,
+		PlannedSha256: opts.PlannedSha256,
+		PlannedSigner: opts.PlannedSigner,
+		Offline:       opts.Offline,
+		CacheLimits:   opts.CacheLimits,
+	}
+
+	var acquirers []APKAcquirer
+	for _, name := range names {
+		newAcquirer, ok := methods[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown APKAcquirer method: %s", name)
+		}
+
+		// All share apk, so whichever acquires the APKs sets its paths
+		acquirers = append(acquirers, newAcquirer(apk, opts))
+	}
+
+	if len(acquirers) == 1 {
+		apk.Method = names[0]
+		return acquirers[0], nil
 	}
 
-	return acq, nil
+	return FallbackPackage{apk, names, acquirers, opts.PreferredMethod}, nil
 }
 
 func Version(apk APKAcquirer) (int, error) {
@@ -0,0 +1,379 @@
+package repo
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// SigningKey signs APKs generated by the provider, e.g. from an Android App Bundle.
+type SigningKey struct {
+	Key  crypto.Signer
+	Cert *x509.Certificate
+}
+
+// LoadSigningKey reads a PEM-encoded private key (PKCS#8, PKCS#1 or SEC 1) and certificate.
+func LoadSigningKey(keyPath string, certPath string) (*SigningKey, error) {
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("No PEM block found in %s", keyPath)
+	}
+
+	var key interface{}
+	if key, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes); err != nil {
+			if key, err = x509.ParseECPrivateKey(keyBlock.Bytes); err != nil {
+				return nil, fmt.Errorf("Failed to parse private key %s: %s", keyPath, err)
+			}
+		}
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key %T in %s", key, keyPath)
+	}
+
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("No PEM block found in %s", certPath)
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse certificate %s: %s", certPath, err)
+	}
+
+	return &SigningKey{signer, cert}, nil
+}
+
+type apkEntry struct {
+	name     string
+	data     []byte
+	compress bool
+}
+
+// apkWriter builds an aligned APK, recording entry digests for its v1 signature.
+type apkWriter struct {
+	buf     bytes.Buffer
+	zw      *zip.Writer
+	entries []apkEntry
+	digests map[string][]byte
+}
+
+func newApkWriter() *apkWriter {
+	w := &apkWriter{digests: make(map[string][]byte)}
+	w.zw = zip.NewWriter(&w.buf)
+	return w
+}
+
+// add queues an entry, to be left uncompressed and aligned (as zipalign would) if !compress.
+func (w *apkWriter) add(name string, data []byte, compress bool) error {
+	if _, ok := w.digests[name]; ok {
+		return fmt.Errorf("Duplicate APK entry %s", name)
+	}
+
+	sum := sha256.Sum256(data)
+	w.entries = append(w.entries, apkEntry{name, data, compress})
+	w.digests[name] = sum[:]
+	return nil
+}
+
+// writeEntries writes the uncompressed entries first, since zip.Writer only finishes an entry
+// (flushing the compressor and writing its data descriptor) when the next is created, so the
+// offset at which to align is only known following another uncompressed entry.
+func (w *apkWriter) writeEntries() error {
+	var stored, deflated []apkEntry
+	for _, e := range w.entries {
+		if e.compress {
+			deflated = append(deflated, e)
+		} else {
+			stored = append(stored, e)
+		}
+	}
+
+	for i, e := range append(stored, deflated...) {
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+
+		if !e.compress {
+			header.Method = zip.Store
+
+			align := 4
+			if path.Ext(e.name) == ".so" {
+				align = 4096
+			}
+
+			if err := w.zw.Flush(); err != nil {
+				return err
+			}
+
+			offset := w.buf.Len()
+			if i > 0 {
+				offset += zipDataDescriptorSize
+			}
+
+			// Pad with zipalign's extra field, 0xd935, so that the data starts on the boundary
+			dataStart := offset + zipLocalHeaderSize + len(e.name) + 4
+			padding := (align - dataStart%align) % align
+			header.Extra = make([]byte, 4+padding)
+			binary.LittleEndian.PutUint16(header.Extra, 0xd935)
+			binary.LittleEndian.PutUint16(header.Extra[2:], uint16(padding))
+		}
+
+		f, err := w.zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if _, err = f.Write(e.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// manifestLine wraps at 72 bytes, as the JAR manifest format requires.
+func manifestLine(line string) string {
+	var out strings.Builder
+	for len(line) > 72 {
+		out.WriteString(line[:72])
+		out.WriteString("\r\n ")
+		line = line[72:]
+	}
+	out.WriteString(line)
+	out.WriteString("\r\n")
+	return out.String()
+}
+
+func (w *apkWriter) signV1(key *SigningKey) error {
+	b64 := base64.StdEncoding.EncodeToString
+
+	manifest := "Manifest-Version: 1.0\r\nCreated-By: terraform-provider-android\r\n\r\n"
+	var sfEntries strings.Builder
+	for _, e := range w.entries {
+		name := e.name
+		section := manifestLine("Name: "+name) + manifestLine("SHA-256-Digest: "+b64(w.digests[name])) + "\r\n"
+		manifest += section
+
+		sectionSum := sha256.Sum256([]byte(section))
+		sfEntries.WriteString(manifestLine("Name: " + name))
+		sfEntries.WriteString(manifestLine("SHA-256-Digest: " + b64(sectionSum[:])))
+		sfEntries.WriteString("\r\n")
+	}
+
+	manifestSum := sha256.Sum256([]byte(manifest))
+	sf := "Signature-Version: 1.0\r\nCreated-By: terraform-provider-android\r\n" +
+		manifestLine("SHA-256-Digest-Manifest: "+b64(manifestSum[:])) +
+		"X-Android-APK-Signed: 2\r\n\r\n" +
+		sfEntries.String()
+
+	signedData, err := pkcs7.NewSignedData([]byte(sf))
+	if err != nil {
+		return err
+	}
+
+	signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err = signedData.SignWithoutAttr(key.Cert, key.Key, pkcs7.SignerInfoConfig{}); err != nil {
+		return err
+	}
+
+	signedData.Detach()
+	block, err := signedData.Finish()
+	if err != nil {
+		return err
+	}
+
+	blockName := "META-INF/CERT.RSA"
+	if _, ok := key.Key.Public().(*ecdsa.PublicKey); ok {
+		blockName = "META-INF/CERT.EC"
+	}
+
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{"META-INF/MANIFEST.MF", []byte(manifest)},
+		{"META-INF/CERT.SF", []byte(sf)},
+		{blockName, block},
+	} {
+		f, err := w.zw.Create(entry.name)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(entry.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sign finishes the APK with v1 (JAR) and v2 (APK Signature Scheme) signatures.
+func (w *apkWriter) Sign(key *SigningKey) ([]byte, error) {
+	if err := w.writeEntries(); err != nil {
+		return nil, err
+	}
+
+	if err := w.signV1(key); err != nil {
+		return nil, fmt.Errorf("Failed to sign (v1): %s", err)
+	}
+
+	if err := w.zw.Close(); err != nil {
+		return nil, err
+	}
+
+	signed, err := signV2(w.buf.Bytes(), key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign (v2): %s", err)
+	}
+
+	return signed, nil
+}
+
+const (
+	apkSigV2BlockID       = 0x7109871a
+	apkSigRSAPKCS1SHA256  = 0x0103
+	apkSigECDSASHA256     = 0x0201
+	apkSigBlockMagic      = "APK Sig Block 42"
+	apkSigChunkSize       = 1 << 20
+	zipLocalHeaderSize    = 30
+	zipDataDescriptorSize = 16
+	zipEOCDSize           = 22
+	zipEOCDCDOffsetOffset = 16
+)
+
+func lengthPrefixed(data ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, d := range data {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(d)))
+		buf.Write(d)
+	}
+	return buf.Bytes()
+}
+
+func uint32LE(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+// apkContentDigest is the v2/v3 schemes' chunked digest over the zip entries, central directory and EOCD.
+func apkContentDigest(newHash func() hash.Hash, sections ...[]byte) []byte {
+	var chunkDigests [][]byte
+	for _, section := range sections {
+		for len(section) > 0 {
+			n := apkSigChunkSize
+			if len(section) < n {
+				n = len(section)
+			}
+
+			h := newHash()
+			h.Write([]byte{0xa5})
+			h.Write(uint32LE(uint32(n)))
+			h.Write(section[:n])
+			chunkDigests = append(chunkDigests, h.Sum(nil))
+			section = section[n:]
+		}
+	}
+
+	h := newHash()
+	h.Write([]byte{0x5a})
+	h.Write(uint32LE(uint32(len(chunkDigests))))
+	for _, d := range chunkDigests {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func signV2(apk []byte, key *SigningKey) ([]byte, error) {
+	if len(apk) < zipEOCDSize {
+		return nil, fmt.Errorf("not a zip")
+	}
+
+	// zip.Writer doesn't write a comment, so the EOCD is exactly at the end
+	eocdOffset := len(apk) - zipEOCDSize
+	eocd := apk[eocdOffset:]
+	if binary.LittleEndian.Uint32(eocd) != 0x06054b50 {
+		return nil, fmt.Errorf("zip end of central directory not found")
+	}
+
+	cdOffset := int(binary.LittleEndian.Uint32(eocd[zipEOCDCDOffsetOffset:]))
+	entries, cd := apk[:cdOffset], apk[cdOffset:eocdOffset]
+
+	var algorithm uint32
+	switch key.Key.Public().(type) {
+	case *rsa.PublicKey:
+		algorithm = apkSigRSAPKCS1SHA256
+	case *ecdsa.PublicKey:
+		algorithm = apkSigECDSASHA256
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key.Key.Public())
+	}
+
+	digest := apkContentDigest(sha256.New, entries, cd, eocd)
+	signedData := lengthPrefixed(
+		lengthPrefixed(append(uint32LE(algorithm), lengthPrefixed(digest)...)),
+		lengthPrefixed(key.Cert.Raw),
+		nil, // additional attributes
+	)
+
+	signedDataSum := sha256.Sum256(signedData)
+	signature, err := key.Key.Sign(rand.Reader, signedDataSum[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := lengthPrefixed(
+		signedData,
+		lengthPrefixed(append(uint32LE(algorithm), lengthPrefixed(signature)...)),
+		key.Cert.RawSubjectPublicKeyInfo,
+	)
+	value := lengthPrefixed(lengthPrefixed(signer))
+
+	var pairs bytes.Buffer
+	binary.Write(&pairs, binary.LittleEndian, uint64(4+len(value)))
+	binary.Write(&pairs, binary.LittleEndian, uint32(apkSigV2BlockID))
+	pairs.Write(value)
+
+	var block bytes.Buffer
+	blockSize := uint64(pairs.Len() + 8 + len(apkSigBlockMagic))
+	binary.Write(&block, binary.LittleEndian, blockSize)
+	block.Write(pairs.Bytes())
+	binary.Write(&block, binary.LittleEndian, blockSize)
+	block.WriteString(apkSigBlockMagic)
+
+	newEOCD := append([]byte{}, eocd...)
+	binary.LittleEndian.PutUint32(newEOCD[zipEOCDCDOffsetOffset:], uint32(cdOffset+block.Len()))
+
+	var out bytes.Buffer
+	out.Write(entries)
+	out.Write(block.Bytes())
+	out.Write(cd)
+	out.Write(newEOCD)
+	return out.Bytes(), nil
+}
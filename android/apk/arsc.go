@@ -0,0 +1,534 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// Android's binary resource table format, resources.arsc, for the APKs generated from bundles.
+
+const (
+	resStringPoolType   = 0x0001
+	resTableType        = 0x0002
+	resTablePackageType = 0x0200
+	resTableTypeType    = 0x0201
+	resTableTypeSpec    = 0x0202
+
+	// Res_value data types
+	typeNull           = 0x00
+	typeReference      = 0x01
+	typeAttribute      = 0x02
+	typeString         = 0x03
+	typeFloat          = 0x04
+	typeDimension      = 0x05
+	typeFraction       = 0x06
+	typeDynamicRef     = 0x07
+	typeDynamicAttr    = 0x08
+	typeIntDec         = 0x10
+	typeIntHex         = 0x11
+	typeIntBoolean     = 0x12
+	typeIntColorARGB8  = 0x1c
+	typeIntColorRGB8   = 0x1d
+	typeIntColorARGB4  = 0x1e
+	typeIntColorRGB4   = 0x1f
+	resValueNullEmpty  = 1
+	resEntryComplex    = 0x0001
+	resEntryPublic     = 0x0002
+	resEntryWeak       = 0x0004
+	resSpecPublic      = 0x40000000
+	resTableNoEntry    = 0xffffffff
+	resTableConfigSize = 64
+
+	// ResTable_map names of attributes' formats and bounds, plurals, and arrays' elements
+	resMapAttrType  = 0x01000000
+	resMapAttrMin   = 0x01000001
+	resMapAttrMax   = 0x01000002
+	resMapAttrOther = 0x01000004
+	resMapAttrZero  = 0x01000005
+	resMapArray     = 0x02000000
+
+	// Densities that aren't of a screen
+	densityAny  = 0xfffe
+	densityNone = 0xffff
+)
+
+// resValue is a Res_value, whose data is the index of str if it's a string.
+type resValue struct {
+	dataType uint8
+	data     uint32
+	str      string
+	spans    []stringSpan
+}
+
+func resBool(value bool) resValue {
+	v := resValue{dataType: typeIntBoolean}
+	if value {
+		v.data = 0xffffffff
+	}
+	return v
+}
+
+type resMap struct {
+	name  uint32
+	value resValue
+}
+
+// resConfig is a ResTable_config, the qualifiers of a value.
+type resConfig struct {
+	mcc, mnc                          uint16
+	language, region, script, variant string
+	numbering                         string
+	orientation, touchscreen          uint8
+	density                           uint16
+	keyboard, navigation, inputFlags  uint8
+	grammaticalInflection             uint8
+	screenWidth, screenHeight         uint16
+	sdkVersion                        uint16
+	screenLayout, uiMode              uint8
+	smallestScreenWidthDp             uint16
+	screenWidthDp, screenHeightDp     uint16
+	screenLayout2, colorMode          uint8
+}
+
+// setLocale sets the locale from its BCP 47 tag, e.g. `sr-Latn-RS`.
+func (c *resConfig) setLocale(tag string) {
+	parts := strings.Split(tag, "-")
+	c.language = strings.ToLower(parts[0])
+
+	for i := 1; i < len(parts); i++ {
+		part := parts[i]
+		switch {
+		case strings.EqualFold(part, "u") && i+2 < len(parts) && strings.EqualFold(parts[i+1], "nu"):
+			c.numbering = strings.ToLower(parts[i+2])
+			i += 2
+		case len(part) == 4 && part[0] >= 'A':
+			c.script = strings.ToUpper(part[:1]) + strings.ToLower(part[1:])
+		case len(part) == 2 || (len(part) == 3 && part[0] <= '9'):
+			c.region = strings.ToUpper(part)
+		case len(part) >= 4:
+			c.variant = strings.ToLower(part)
+		}
+	}
+}
+
+// packLocale packs a two letter code as is, and a three letter code into two bytes from base.
+func packLocale(code string, base byte) [2]byte {
+	switch len(code) {
+	case 2:
+		return [2]byte{code[0], code[1]}
+	case 3:
+		first, second, third := code[0]-base, code[1]-base, code[2]-base
+		return [2]byte{0x80 | third<<2 | second>>3, second<<5 | first}
+	}
+	return [2]byte{}
+}
+
+func (c resConfig) encode() []byte {
+	b := make([]byte, resTableConfigSize)
+	le := binary.LittleEndian
+
+	le.PutUint32(b[0:], resTableConfigSize)
+	le.PutUint16(b[4:], c.mcc)
+	le.PutUint16(b[6:], c.mnc)
+	language, region := packLocale(c.language, 'a'), packLocale(c.region, '0')
+	copy(b[8:], language[:])
+	copy(b[10:], region[:])
+	b[12], b[13] = c.orientation, c.touchscreen
+	le.PutUint16(b[14:], c.density)
+	b[16], b[17], b[18], b[19] = c.keyboard, c.navigation, c.inputFlags, c.grammaticalInflection
+	le.PutUint16(b[20:], c.screenWidth)
+	le.PutUint16(b[22:], c.screenHeight)
+	le.PutUint16(b[24:], c.sdkVersion)
+	b[28], b[29] = c.screenLayout, c.uiMode
+	le.PutUint16(b[30:], c.smallestScreenWidthDp)
+	le.PutUint16(b[32:], c.screenWidthDp)
+	le.PutUint16(b[34:], c.screenHeightDp)
+	copy(b[36:40], c.script)
+	copy(b[40:48], c.variant)
+	b[48], b[49] = c.screenLayout2, c.colorMode
+	// With no script, localeScriptWasComputed is left unset, for the platform to compute it
+	copy(b[53:61], c.numbering)
+
+	return b
+}
+
+// changes is the mask of kinds of configuration change that select between values, of those
+// that c qualifies.
+func (c resConfig) changes() uint32 {
+	var mask uint32
+	for _, q := range []struct {
+		set  bool
+		flag uint32
+	}{
+		{c.mcc != 0, 0x0001},
+		{c.mnc != 0, 0x0002},
+		{c.language != "" || c.region != "" || c.script != "" || c.variant != "" || c.numbering != "", 0x0004},
+		{c.touchscreen != 0, 0x0008},
+		{c.keyboard != 0, 0x0010},
+		{c.inputFlags != 0, 0x0020},
+		{c.navigation != 0, 0x0040},
+		{c.orientation != 0, 0x0080},
+		{c.density != 0, 0x0100},
+		{c.screenWidth != 0 || c.screenHeight != 0 || c.screenWidthDp != 0 || c.screenHeightDp != 0, 0x0200},
+		{c.sdkVersion != 0, 0x0400},
+		{c.screenLayout&^0xc0 != 0, 0x0800},
+		{c.uiMode != 0, 0x1000},
+		{c.smallestScreenWidthDp != 0, 0x2000},
+		{c.screenLayout&0xc0 != 0, 0x4000},
+		{c.screenLayout2 != 0, 0x8000},
+		{c.colorMode != 0, 0x10000},
+		{c.grammaticalInflection != 0, 0x20000},
+	} {
+		if q.set {
+			mask |= q.flag
+		}
+	}
+	return mask
+}
+
+// withoutDensity is a key of the configuration's qualifiers other than density.
+func (c resConfig) withoutDensity() string {
+	c.density = 0
+	return string(c.encode())
+}
+
+// densityBetter reports whether a value of density a is a better match than one of b for a
+// screen of density requested, as the platform decides.
+func densityBetter(a, b uint16, requested int) bool {
+	if a == densityAny {
+		return true
+	}
+	if b == densityAny {
+		return false
+	}
+
+	if requested == 0 {
+		requested = 160
+	}
+	this, other := int(a), int(b)
+	if this == 0 {
+		this = 160
+	}
+	if other == 0 {
+		other = 160
+	}
+
+	h, l, imBigger := this, other, true
+	if l > h {
+		h, l, imBigger = l, h, false
+	}
+
+	switch {
+	case requested >= h:
+		return imBigger
+	case l >= requested:
+		return !imBigger
+	case (2*l-requested)*h > requested*requested:
+		// Scaling down is twice as good as scaling up
+		return !imBigger
+	default:
+		return imBigger
+	}
+}
+
+type resConfigValue struct {
+	config resConfig
+	weak   bool
+
+	// A simple value, unless complex
+	value   resValue
+	complex bool
+	parent  uint32
+	maps    []resMap
+
+	// file is the path of the file the value is, if any, which must be converted from protobuf
+	// XML if protoXML
+	file     string
+	protoXML bool
+}
+
+type resEntry struct {
+	id     uint32
+	name   string
+	public bool
+	values []*resConfigValue
+}
+
+type resType struct {
+	id      uint32
+	name    string
+	entries []*resEntry
+}
+
+type resPackage struct {
+	id    uint32
+	name  string
+	types []*resType
+}
+
+func (t *resType) entryCount() uint32 {
+	var count uint32
+	for _, e := range t.entries {
+		if e.id >= count {
+			count = e.id + 1
+		}
+	}
+	return count
+}
+
+// arscEncoder encodes a resource table with just the values that keep selects.
+type arscEncoder struct {
+	keep   func(*resConfigValue) bool
+	values *stringPool
+	// Indices of styled strings, which aren't shared
+	styled map[*resValue]uint32
+}
+
+// encodeArsc encodes the packages with just the values that keep selects, or returns nil if
+// there are none.
+func encodeArsc(packages []*resPackage, keep func(*resConfigValue) bool) ([]byte, error) {
+	enc := &arscEncoder{keep: keep, values: newStringPool(), styled: make(map[*resValue]uint32)}
+
+	var kept []*resConfigValue
+	for _, pkg := range packages {
+		for _, t := range pkg.types {
+			for _, e := range t.entries {
+				for _, cv := range e.values {
+					if keep(cv) {
+						kept = append(kept, cv)
+					}
+				}
+			}
+		}
+	}
+	if len(kept) == 0 {
+		return nil, nil
+	}
+
+	// Styled strings must be pooled first, then the tags of their spans
+	var styled []*resValue
+	for _, cv := range kept {
+		for _, v := range cv.resValues() {
+			if v.dataType == typeString && len(v.spans) > 0 {
+				enc.styled[v] = enc.values.addStyled(v.str, v.spans)
+				styled = append(styled, v)
+			}
+		}
+	}
+	for _, v := range styled {
+		for _, span := range v.spans {
+			enc.values.add(span.tag)
+		}
+	}
+
+	var chunks bytes.Buffer
+	for _, pkg := range packages {
+		chunk, err := enc.encodePackage(pkg)
+		if err != nil {
+			return nil, err
+		}
+		chunks.Write(chunk)
+	}
+
+	valuePool, err := enc.values.encode(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, []uint16{resTableType, 12})
+	binary.Write(&out, binary.LittleEndian, []uint32{uint32(12 + len(valuePool) + chunks.Len()), uint32(len(packages))})
+	out.Write(valuePool)
+	out.Write(chunks.Bytes())
+	return out.Bytes(), nil
+}
+
+// resValues are the Res_values of the value.
+func (cv *resConfigValue) resValues() []*resValue {
+	if !cv.complex {
+		return []*resValue{&cv.value}
+	}
+
+	values := make([]*resValue, len(cv.maps))
+	for i := range cv.maps {
+		values[i] = &cv.maps[i].value
+	}
+	return values
+}
+
+func (enc *arscEncoder) writeValue(buf *bytes.Buffer, v *resValue) {
+	data := v.data
+	if v.dataType == typeString {
+		if i, ok := enc.styled[v]; ok {
+			data = i
+		} else {
+			data = enc.values.add(v.str)
+		}
+	}
+	binary.Write(buf, binary.LittleEndian, uint16(8))
+	buf.Write([]byte{0, v.dataType})
+	binary.Write(buf, binary.LittleEndian, data)
+}
+
+func (enc *arscEncoder) encodePackage(pkg *resPackage) ([]byte, error) {
+	typeNames, keys := newStringPool(), newStringPool()
+
+	var maxType uint32
+	for _, t := range pkg.types {
+		if t.id > maxType {
+			maxType = t.id
+		}
+	}
+	names := make([]string, maxType)
+	for i := range names {
+		names[i] = "?"
+	}
+	for _, t := range pkg.types {
+		names[t.id-1] = t.name
+	}
+	for _, name := range names {
+		typeNames.addUnique(name)
+	}
+
+	for _, t := range pkg.types {
+		for _, e := range t.entries {
+			for _, cv := range e.values {
+				if enc.keep(cv) {
+					keys.add(e.name)
+					break
+				}
+			}
+		}
+	}
+
+	var chunks bytes.Buffer
+	for _, t := range pkg.types {
+		count := t.entryCount()
+
+		flags := make([]uint32, count)
+		configs := make(map[string]map[uint32]*resConfigValue)
+		var order []resConfig
+		for _, e := range t.entries {
+			for _, cv := range e.values {
+				flags[e.id] |= cv.config.changes()
+				if e.public {
+					flags[e.id] |= resSpecPublic
+				}
+
+				if !enc.keep(cv) {
+					continue
+				}
+
+				key := string(cv.config.encode())
+				if configs[key] == nil {
+					configs[key] = make(map[uint32]*resConfigValue)
+					order = append(order, cv.config)
+				}
+				if _, ok := configs[key][e.id]; ok {
+					return nil, fmt.Errorf("Duplicate value of %s/%s for a configuration", t.name, e.name)
+				}
+				configs[key][e.id] = cv
+			}
+		}
+		if len(order) == 0 {
+			continue
+		}
+
+		binary.Write(&chunks, binary.LittleEndian, []uint16{resTableTypeSpec, 16})
+		binary.Write(&chunks, binary.LittleEndian, uint32(16+4*count))
+		chunks.Write([]byte{byte(t.id), 0})
+		binary.Write(&chunks, binary.LittleEndian, uint16(len(order)))
+		binary.Write(&chunks, binary.LittleEndian, count)
+		binary.Write(&chunks, binary.LittleEndian, flags)
+
+		entriesByID := make(map[uint32]*resEntry)
+		for _, e := range t.entries {
+			entriesByID[e.id] = e
+		}
+
+		for _, config := range order {
+			byID := configs[string(config.encode())]
+
+			offsets := make([]uint32, count)
+			var entries bytes.Buffer
+			for id := uint32(0); id < count; id++ {
+				cv, ok := byID[id]
+				if !ok {
+					offsets[id] = resTableNoEntry
+					continue
+				}
+				offsets[id] = uint32(entries.Len())
+
+				var entryFlags uint16
+				if entriesByID[id].public {
+					entryFlags |= resEntryPublic
+				}
+				if cv.weak {
+					entryFlags |= resEntryWeak
+				}
+				key := keys.add(entriesByID[id].name)
+
+				if !cv.complex {
+					binary.Write(&entries, binary.LittleEndian, []uint16{8, entryFlags})
+					binary.Write(&entries, binary.LittleEndian, key)
+					enc.writeValue(&entries, &cv.value)
+					continue
+				}
+
+				binary.Write(&entries, binary.LittleEndian, []uint16{16, entryFlags | resEntryComplex})
+				binary.Write(&entries, binary.LittleEndian, []uint32{key, cv.parent, uint32(len(cv.maps))})
+				for i := range cv.maps {
+					binary.Write(&entries, binary.LittleEndian, cv.maps[i].name)
+					enc.writeValue(&entries, &cv.maps[i].value)
+				}
+			}
+
+			headerSize := 20 + resTableConfigSize
+			entriesStart := headerSize + 4*int(count)
+			binary.Write(&chunks, binary.LittleEndian, []uint16{resTableTypeType, uint16(headerSize)})
+			binary.Write(&chunks, binary.LittleEndian, uint32(entriesStart+entries.Len()))
+			chunks.Write([]byte{byte(t.id), 0, 0, 0})
+			binary.Write(&chunks, binary.LittleEndian, []uint32{count, uint32(entriesStart)})
+			chunks.Write(config.encode())
+			binary.Write(&chunks, binary.LittleEndian, offsets)
+			chunks.Write(entries.Bytes())
+		}
+	}
+
+	typePool, err := typeNames.encode(false)
+	if err != nil {
+		return nil, err
+	}
+	keyPool, err := keys.encode(true)
+	if err != nil {
+		return nil, err
+	}
+
+	const headerSize = 288
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, []uint16{resTablePackageType, headerSize})
+	binary.Write(&out, binary.LittleEndian, []uint32{uint32(headerSize + len(typePool) + len(keyPool) + chunks.Len()), pkg.id})
+	name := make([]uint16, 128)
+	copy(name[:127], utf16.Encode([]rune(pkg.name)))
+	binary.Write(&out, binary.LittleEndian, name)
+	binary.Write(&out, binary.LittleEndian, []uint32{
+		headerSize, // type strings
+		uint32(len(typeNames.strings)),
+		uint32(headerSize + len(typePool)), // key strings
+		uint32(len(keys.strings)),
+		0, // type ID offset
+	})
+	out.Write(typePool)
+	out.Write(keyPool)
+	out.Write(chunks.Bytes())
+	return out.Bytes(), nil
+}
+
+// sortMaps orders a style's attributes by ID, as the platform expects.
+func sortMaps(maps []resMap) {
+	sort.SliceStable(maps, func(i, j int) bool { return maps[i].name < maps[j].name })
+}
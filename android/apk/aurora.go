@@ -3,16 +3,11 @@ package repo
 import (
 	"fmt"
 	"log"
-	"math"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
-	"github.com/adrg/xdg"
-	aapt "github.com/shogo82148/androidbinary/apk"
 	"mvdan.cc/fdroidcl/adb"
 
 	_ "embed"
@@ -22,44 +17,43 @@ import (
 var comAuroraStoreApk []byte
 
 type AuroraPackage struct {
-	apk *Apk
+	apk      *Apk
+	timeouts AuroraTimeouts
+}
+
+func init() {
+	RegisterMethod("aurora", func(apk *Apk, opts Options) APKAcquirer {
+		return RefreshedPackage{AuroraPackage{apk, opts.AuroraTimeouts}, "aurora", opts.RefreshInterval}
+	})
 }
 
 func (pkg AuroraPackage) Apk() *Apk {
 	return pkg.apk
 }
 
-func (pkg AuroraPackage) triggerDownload(device *adb.Device) error {
-	log.Printf("[DEBUG] Requested AuroraStore to download %s", pkg.apk.Name)
+// triggerAuroraDownload opens the details of pkg in AuroraStore, which downloads it.
+func triggerAuroraDownload(device *adb.Device, pkg string) error {
+	log.Printf("[DEBUG] Requested AuroraStore to download %s", pkg)
 	cmd := device.AdbCmd(
 		"shell",
 		"am",
 		"start",
 		"-n", "com.aurora.store.debug/com.aurora.store.view.ui.details.AppDetailsActivity",
-		"-d", fmt.Sprintf("market://?id=%s\\&download", pkg.apk.Name),
+		"-d", fmt.Sprintf("market://?id=%s\\&download", pkg),
 	)
 
 	stdouterr, err := cmd.CombinedOutput()
 	log.Println(string(stdouterr))
 	if strings.Contains(string(stdouterr), "Activity class {com.aurora.store.debug/com.aurora.store.view.ui.details.AppDetailsActivity} does not exist") {
-		return fmt.Errorf("Failed to trigger download for %s: is `com.aurora.store.debug` installed?", pkg.apk.Name)
+		return fmt.Errorf("Failed to trigger download for %s: is `com.aurora.store.debug` installed?", pkg)
 	}
 	if err != nil {
-		return fmt.Errorf("Failed to trigger download for %s: %s", pkg.apk.Name, stdouterr)
+		return fmt.Errorf("Failed to trigger download for %s: %s", pkg, stdouterr)
 	}
 
 	return nil
 }
 
-func getCacheDir() (string, error) {
-	dir, err := xdg.CacheFile("terraform-android/aurora")
-	if err != nil {
-		return "", err
-	}
-
-	return dir, nil
-}
-
 func (pkg AuroraPackage) GetApkPaths(device *adb.Device, version *int) ([]string, error) {
 	if pkg.Apk().Paths != nil {
 		return pkg.Apk().Paths, nil
@@ -69,107 +63,103 @@ func (pkg AuroraPackage) GetApkPaths(device *adb.Device, version *int) ([]string
 		return nil, fmt.Errorf("version required")
 	}
 
-	cacheDir, err := getCacheDir()
+	paths, ok, err := cachedByVersion(pkg.apk, *version)
 	if err != nil {
 		return nil, err
 	}
 
-	pkgDir := fmt.Sprintf("%s/%s/%d", cacheDir, pkg.apk.Name, *version)
-	_, err = os.Stat(pkgDir)
-	if os.IsNotExist(err) {
+	if !ok && pkg.apk.Offline {
+		return nil, errNotCached(fmt.Sprintf("%s @ %d", pkg.apk.Name, *version))
+	}
+
+	if !ok {
 		if err = pkg.UpdateCache(device); err != nil {
 			return nil, err
 		}
+
+		if paths, ok, err = cachedByVersion(pkg.apk, *version); err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("AuroraStore didn't download the build of %s @ %d that was planned", pkg.apk.Name, *version)
+		}
 	}
 
-	basePath := fmt.Sprintf("%s/%s.apk", pkgDir, pkg.apk.Name)
-	pkg.apk.BasePath = &basePath
-	pkg.apk.Paths, err = filepath.Glob(fmt.Sprintf("%s/*.apk", pkgDir))
+	pkg.apk.BasePath = &paths[0]
+	pkg.apk.Paths = paths
 	return pkg.apk.Paths, nil
 }
 
 func (pkg AuroraPackage) UpdateCache(device *adb.Device) error {
-	apkDir, err := getCacheDir()
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(apkDir, 0775)
+	stagingDir, err := cacheStagingDir()
 	if err != nil {
 		return err
 	}
+	defer os.RemoveAll(stagingDir)
 
 	if pkg.apk.Name == "com.aurora.store.debug" {
 		log.Println("[DEBUG] Bootstrapping AuroraStore")
-		apkPath := fmt.Sprintf("%s/%s.apk", apkDir, pkg.apk.Name)
-		pkg.apk.BasePath = &apkPath
-		pkg.apk.Paths = []string{apkPath}
-
+		apkPath := fmt.Sprintf("%s/%s.apk", stagingDir, pkg.apk.Name)
 		if err = os.WriteFile(apkPath, comAuroraStoreApk, 0666); err != nil {
 			log.Println("[ERROR] Failed to bootstrap AuroraStore")
 			return err
 		}
-		return nil
-	}
 
-	err = pkg.triggerDownload(device)
-	if err != nil {
-		return err
-	}
-
-	auroraPkgDir := fmt.Sprintf("sdcard/Aurora/Store/Downloads/%s", pkg.apk.Name)
-	downloadMarkers := fmt.Sprintf("%s/.*.download-*", auroraPkgDir)
-
-	var stdout []byte
-	for i := 3; strings.Contains(string(stdout), "download-in-progress") || !strings.Contains(string(stdout), "download-complete"); i++ {
-		if i >= 6 {
-			i = 0
-			err = pkg.triggerDownload(device)
-			if err != nil {
-				return err
-			}
-		}
-		time.Sleep(time.Duration(math.Pow(2, float64(i))) * time.Second)
-
-		// || true to handle dir not existing, or no download markers existing yet
-		cmd := device.AdbCmd("shell", "ls", "-A1t", downloadMarkers, "||", "true")
-		stdout, err = cmd.Output()
+		paths, err := cacheStore([]string{apkPath}, "", pkg.apk.evictionLimits())
 		if err != nil {
 			return err
 		}
+
+		pkg.apk.BasePath = &paths[0]
+		pkg.apk.Paths = paths
+		return nil
+	}
+
+	if pkg.apk.Offline {
+		return updateFromCache(pkg.apk)
 	}
 
-	re := regexp.MustCompile(`.(?P<version>[0-9]+).download-complete`)
-	matches := re.FindSubmatch(stdout)
-	index := re.SubexpIndex("version")
-	versionDownloaded, err := strconv.Atoi(string(matches[index]))
+	versionDownloaded, err := downloadAurora(device, pkg.apk.Name, pkg.timeouts)
 	if err != nil {
 		return err
 	}
 	log.Printf("[INFO] Downloaded %s @ %d", pkg.apk.Name, versionDownloaded)
 
-	apkOk := false
-	for retries := 3; retries > 0 && !apkOk; retries-- {
-		cmd := device.AdbCmd("pull", auroraPkgDir, fmt.Sprintf("%s/", apkDir))
+	auroraPkgDir := fmt.Sprintf("sdcard/Aurora/Store/Downloads/%s", pkg.apk.Name)
+	var paths []string
+	for retries := 3; retries > 0 && paths == nil; retries-- {
+		cmd := device.AdbCmd("pull", auroraPkgDir, fmt.Sprintf("%s/", stagingDir))
 		stdouterr, err := cmd.CombinedOutput()
 		log.Println(string(stdouterr))
 		if err != nil {
 			return fmt.Errorf("Failed to retrieve %s: %s", pkg.apk.Name, stdouterr)
 		}
 
-		if _, err = pkg.GetApkPaths(device, &versionDownloaded); err != nil {
-			return err
-		}
-
-		if _, err := aapt.OpenFile(*pkg.apk.BasePath); err == nil {
-			log.Printf("[ERROR] Failed to read %s: %s", *pkg.apk.BasePath, err)
-			apkOk = true
+		if paths, err = storeAuroraDownload(stagingDir, pkg.apk.Name, versionDownloaded, pkg.apk.evictionLimits()); err != nil {
+			log.Printf("[ERROR] Failed to read %s: %s", pkg.apk.Name, err)
 		}
 	}
 
-	if !apkOk {
+	if paths == nil {
 		return fmt.Errorf("%s APK corrupted", pkg.apk.Name)
 	}
 
+	pkg.apk.BasePath = &paths[0]
+	pkg.apk.Paths = paths
 	return nil
 }
+
+// storeAuroraDownload caches the APKs of pkg @ versionCode from AuroraStore's download directory
+// of pkg, as pulled into dir, which has a subdirectory of each version downloaded.
+func storeAuroraDownload(dir string, pkg string, versionCode int, limits CacheLimits) ([]string, error) {
+	pulled, err := filepath.Glob(filepath.Join(dir, pkg, strconv.Itoa(versionCode), "*.apk"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pulled) == 0 {
+		return nil, fmt.Errorf("no APKs of %s @ %d downloaded", pkg, versionCode)
+	}
+
+	return cacheStore(pulled, "", limits)
+}
@@ -0,0 +1,134 @@
+package repo
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"mvdan.cc/fdroidcl/adb"
+)
+
+// AuroraStore doesn't report the downloads it's asked for, so they're followed only by polling
+// for the markers it leaves in the download directory of each package:
+//
+//	.<versionCode>.download-in-progress
+//	.<versionCode>.download-complete
+//
+// A download that fails leaves no marker, and is noticed only by the download timeout.
+
+// AuroraTimeouts bounds waiting on AuroraStore. Zero values mean no limit.
+type AuroraTimeouts struct {
+	// Time for a download to start, after which it's requested again
+	Start time.Duration
+	// Total time for a download to complete
+	Download time.Duration
+}
+
+// Markers of completed downloads, newest first as listed
+var auroraMarkerComplete = regexp.MustCompile(`\.([0-9]+)\.download-complete`)
+
+const auroraPollInterval = 5 * time.Second
+
+func auroraMarkers(pkg string) string {
+	return fmt.Sprintf("sdcard/Aurora/Store/Downloads/%s/.*.download-*", pkg)
+}
+
+// clearAuroraMarkers removes the markers of completed downloads of pkg, so that one left by an
+// earlier download isn't mistaken for the next.
+func clearAuroraMarkers(device *adb.Device, pkg string) error {
+	stdouterr, err := device.AdbShell("rm", "-f", strings.Replace(auroraMarkers(pkg), "download-*", "download-complete", 1)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to clear AuroraStore's download markers of %s: %s", pkg, stdouterr)
+	}
+	return nil
+}
+
+// pollAuroraMarkers reads the markers AuroraStore leaves in the download directory of pkg: the
+// versionCode downloaded if complete, else whether it's in progress.
+func pollAuroraMarkers(device *adb.Device, pkg string) (int, bool, error) {
+	// || true to handle dir not existing, or no download markers existing yet
+	stdout, err := device.AdbShell("ls", "-A1t", auroraMarkers(pkg), "||", "true").Output()
+	if err != nil {
+		return 0, false, err
+	}
+
+	if m := auroraMarkerComplete.FindStringSubmatch(string(stdout)); m != nil {
+		versionCode, err := strconv.Atoi(m[1])
+		return versionCode, false, err
+	}
+
+	return 0, strings.Contains(string(stdout), "download-in-progress"), nil
+}
+
+// downloadAurora requests pkg of AuroraStore, and returns the versionCode that it downloads.
+func downloadAurora(device *adb.Device, pkg string, timeouts AuroraTimeouts) (int, error) {
+	if err := clearAuroraMarkers(device, pkg); err != nil {
+		return 0, err
+	}
+
+	retrigger := func() error {
+		return triggerAuroraDownload(device, pkg)
+	}
+	if err := retrigger(); err != nil {
+		return 0, err
+	}
+
+	return waitAurora(pkg, timeouts, auroraPollInterval, retrigger, func() (int, bool, error) {
+		return pollAuroraMarkers(device, pkg)
+	})
+}
+
+// waitAurora polls for the versionCode of pkg that AuroraStore downloads, every interval. If it's
+// not started within the start timeout, it's requested again with retrigger.
+func waitAurora(pkg string, timeouts AuroraTimeouts, interval time.Duration, retrigger func() error, poll func() (int, bool, error)) (int, error) {
+	startTimer, startTimeout := timeoutChan(timeouts.Start)
+	if startTimer != nil {
+		defer startTimer.Stop()
+	}
+	downloadTimer, downloadTimeout := timeoutChan(timeouts.Download)
+	if downloadTimer != nil {
+		defer downloadTimer.Stop()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-startTimeout:
+			log.Printf("[WARN] AuroraStore didn't start downloading %s within %s, requesting it again", pkg, timeouts.Start)
+			if err := retrigger(); err != nil {
+				return 0, err
+			}
+			startTimer.Reset(timeouts.Start)
+
+		case <-ticker.C:
+			versionCode, started, err := poll()
+			if err != nil {
+				return 0, err
+			}
+			if versionCode != 0 {
+				return versionCode, nil
+			}
+			if started && startTimeout != nil {
+				log.Printf("[DEBUG] AuroraStore started downloading %s", pkg)
+				startTimer.Stop()
+				startTimeout = nil
+			}
+
+		case <-downloadTimeout:
+			return 0, fmt.Errorf("AuroraStore didn't finish downloading %s within %s; it doesn't report failed downloads", pkg, timeouts.Download)
+		}
+	}
+}
+
+func timeoutChan(d time.Duration) (*time.Timer, <-chan time.Time) {
+	if d <= 0 {
+		return nil, nil
+	}
+	timer := time.NewTimer(d)
+	return timer, timer.C
+}
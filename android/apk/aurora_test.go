@@ -0,0 +1,101 @@
+package repo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreAuroraDownload(t *testing.T) {
+	useTestCache(t)
+	apks := testSplitApks(t, testSigningKey(t))
+
+	// As pulled from /sdcard/Aurora/Store/Downloads/org.example.app, with a stale version
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"org.example.app/.41.download-complete":  nil,
+		"org.example.app/.42.download-complete":  nil,
+		"org.example.app/41/org.example.app.apk": []byte("stale"),
+	}
+	for name, data := range apks {
+		if name == "base" {
+			name = "org.example.app"
+		}
+		files["org.example.app/42/"+name+".apk"] = data
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := storeAuroraDownload(dir, "org.example.app", 42, CacheLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != len(apks) || filepath.Base(paths[0]) != "base.apk" {
+		t.Errorf("Cached %v, want %d APKs, base first", paths, len(apks))
+	}
+
+	if paths, err = storeAuroraDownload(dir, "org.example.app", 43, CacheLimits{}); err == nil {
+		t.Errorf("Cached %v of a version not downloaded", paths)
+	}
+}
+
+func TestWaitAurora(t *testing.T) {
+	type progress struct {
+		versionCode int
+		started     bool
+	}
+
+	for _, tc := range []struct {
+		name       string
+		polls      []progress
+		timeouts   AuroraTimeouts
+		retriggers int
+		err        string
+	}{
+		{name: "complete", polls: []progress{{}, {started: true}, {versionCode: 42}}},
+		{name: "restarted", polls: []progress{{}, {}, {}, {}, {versionCode: 42}}, timeouts: AuroraTimeouts{Start: 35 * time.Millisecond}, retriggers: 1},
+		{name: "started", polls: []progress{{started: true}, {started: true}, {started: true}, {versionCode: 42}}, timeouts: AuroraTimeouts{Start: 25 * time.Millisecond}},
+		{name: "failed", polls: []progress{{started: true}}, timeouts: AuroraTimeouts{Download: 50 * time.Millisecond}, err: "AuroraStore didn't finish downloading org.example.app within 50ms; it doesn't report failed downloads"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			retriggers, polls := 0, 0
+			versionCode, err := waitAurora("org.example.app", tc.timeouts, 10*time.Millisecond, func() error {
+				retriggers++
+				return nil
+			}, func() (int, bool, error) {
+				p := tc.polls[len(tc.polls)-1]
+				if polls < len(tc.polls) {
+					p = tc.polls[polls]
+				}
+				polls++
+				return p.versionCode, p.started, nil
+			})
+
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("Got error %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if versionCode != 42 {
+				t.Errorf("Got versionCode %d, want 42", versionCode)
+			}
+			if retriggers != tc.retriggers {
+				t.Errorf("Requested again %d times, want %d", retriggers, tc.retriggers)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// Android's binary XML format, for the manifests and resources of the APKs generated from bundles.
+
+const (
+	axmlNamespace      = "http://schemas.android.com/apk/res/android"
+	axmlToolsNamespace = "http://schemas.android.com/tools"
+
+	resXMLType            = 0x0003
+	resXMLStartNamespace  = 0x0100
+	resXMLEndNamespace    = 0x0101
+	resXMLStartElement    = 0x0102
+	resXMLEndElement      = 0x0103
+	resXMLCData           = 0x0104
+	resXMLResourceMapType = 0x0180
+
+	// android:id, whose index in an element is recorded, as are those of plain class and style
+	axmlIDAttr = 0x010100d0
+
+	noIndex = 0xffffffff
+)
+
+type axmlNamespaceDecl struct {
+	prefix string
+	uri    string
+}
+
+type axmlAttr struct {
+	ns   string
+	name string
+	// resID is that of attributes of the framework or app, e.g. android:versionCode
+	resID uint32
+	value resValue
+}
+
+func axmlString(name string, value string) axmlAttr {
+	return axmlAttr{name: name, value: resValue{dataType: typeString, str: value}}
+}
+
+func axmlAndroidInt(resID uint32, name string, value int) axmlAttr {
+	return axmlAttr{ns: axmlNamespace, resID: resID, name: name, value: resValue{dataType: typeIntDec, data: uint32(value)}}
+}
+
+func axmlAndroidBool(resID uint32, name string, value bool) axmlAttr {
+	return axmlAttr{ns: axmlNamespace, resID: resID, name: name, value: resBool(value)}
+}
+
+// axmlElement is an element, or a text node if it has no name.
+type axmlElement struct {
+	namespaces []axmlNamespaceDecl
+	ns         string
+	name       string
+	attrs      []axmlAttr
+	children   []*axmlElement
+	text       string
+	line       uint32
+}
+
+func (el *axmlElement) attr(ns string, name string) (axmlAttr, bool) {
+	for _, a := range el.attrs {
+		if a.ns == ns && a.name == name {
+			return a, true
+		}
+	}
+	return axmlAttr{}, false
+}
+
+// setAttr replaces the attribute of the same name, or adds it.
+func (el *axmlElement) setAttr(attr axmlAttr) {
+	for i, a := range el.attrs {
+		if a.ns == attr.ns && a.name == attr.name {
+			el.attrs[i] = attr
+			return
+		}
+	}
+	el.attrs = append(el.attrs, attr)
+}
+
+func (el *axmlElement) child(ns string, name string) *axmlElement {
+	for _, c := range el.children {
+		if c.ns == ns && c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// sortedAttrs orders attributes with resource IDs first, by ID, as the platform's lookups
+// expect, then the rest by namespace and name, without any of the tools namespace.
+func (el *axmlElement) sortedAttrs() []axmlAttr {
+	var attrs []axmlAttr
+	for _, a := range el.attrs {
+		if a.ns != axmlToolsNamespace {
+			attrs = append(attrs, a)
+		}
+	}
+
+	sort.SliceStable(attrs, func(i, j int) bool {
+		a, b := attrs[i], attrs[j]
+		switch {
+		case a.resID != 0 && b.resID != 0:
+			return a.resID < b.resID
+		case a.resID != 0 || b.resID != 0:
+			return a.resID != 0
+		case a.ns != b.ns:
+			return a.ns < b.ns
+		default:
+			return a.name < b.name
+		}
+	})
+	return attrs
+}
+
+// axmlLine is the line of a node, which generated ones don't have.
+func axmlLine(line uint32) uint32 {
+	if line == 0 {
+		return 1
+	}
+	return line
+}
+
+func writeAXMLNode(buf *bytes.Buffer, chunkType uint16, line uint32, body []uint32) {
+	binary.Write(buf, binary.LittleEndian, []uint16{chunkType, 16})
+	binary.Write(buf, binary.LittleEndian, uint32(16+4*len(body)))
+	binary.Write(buf, binary.LittleEndian, []uint32{axmlLine(line), noIndex}) // comment
+	binary.Write(buf, binary.LittleEndian, body)
+}
+
+func (p *stringPool) indexOf(s string) uint32 {
+	if s == "" {
+		return noIndex
+	}
+	return p.add(s)
+}
+
+// encodeAXML encodes the document of root.
+func encodeAXML(root *axmlElement) ([]byte, error) {
+	pool := newStringPool()
+
+	// Names of attributes with resource IDs must come first in the pool, in the order of the
+	// resource map, and not be shared with strings that aren't those attributes
+	var resIDs []uint32
+	attrNames := make(map[uint32]uint32)
+	var collectResIDs func(el *axmlElement)
+	collectResIDs = func(el *axmlElement) {
+		for _, a := range el.attrs {
+			if _, ok := attrNames[a.resID]; a.resID != 0 && !ok {
+				attrNames[a.resID] = pool.addUnique(a.name)
+				resIDs = append(resIDs, a.resID)
+			}
+		}
+		for _, c := range el.children {
+			collectResIDs(c)
+		}
+	}
+	collectResIDs(root)
+
+	var body bytes.Buffer
+	var writeElement func(el *axmlElement)
+	writeElement = func(el *axmlElement) {
+		if el.name == "" {
+			if len(bytes.TrimSpace([]byte(el.text))) == 0 {
+				return
+			}
+			// The text, and an untyped Res_value
+			writeAXMLNode(&body, resXMLCData, el.line, []uint32{pool.add(el.text), 8 | typeNull<<24, 0})
+			return
+		}
+
+		for _, ns := range el.namespaces {
+			writeAXMLNode(&body, resXMLStartNamespace, el.line, []uint32{pool.indexOf(ns.prefix), pool.indexOf(ns.uri)})
+		}
+
+		ns, name := pool.indexOf(el.ns), pool.add(el.name)
+
+		var attrs bytes.Buffer
+		var idIndex, classIndex, styleIndex uint16
+		sorted := el.sortedAttrs()
+		for i, a := range sorted {
+			switch {
+			case a.resID == axmlIDAttr:
+				idIndex = uint16(i + 1)
+			case a.ns == "" && a.name == "class":
+				classIndex = uint16(i + 1)
+			case a.ns == "" && a.name == "style":
+				styleIndex = uint16(i + 1)
+			}
+
+			attrName := pool.add(a.name)
+			if a.resID != 0 {
+				attrName = attrNames[a.resID]
+			}
+
+			// Only strings keep their raw value
+			raw, data := uint32(noIndex), a.value.data
+			if a.value.dataType == typeString {
+				raw = pool.add(a.value.str)
+				data = raw
+			}
+
+			binary.Write(&attrs, binary.LittleEndian, []uint32{pool.indexOf(a.ns), attrName, raw})
+			binary.Write(&attrs, binary.LittleEndian, uint16(8))
+			attrs.Write([]byte{0, a.value.dataType})
+			binary.Write(&attrs, binary.LittleEndian, data)
+		}
+
+		binary.Write(&body, binary.LittleEndian, []uint16{resXMLStartElement, 16})
+		binary.Write(&body, binary.LittleEndian, uint32(16+20+attrs.Len()))
+		binary.Write(&body, binary.LittleEndian, []uint32{axmlLine(el.line), noIndex, ns, name})
+		binary.Write(&body, binary.LittleEndian, []uint16{20, 20, uint16(len(sorted)), idIndex, classIndex, styleIndex})
+		body.Write(attrs.Bytes())
+
+		for _, c := range el.children {
+			writeElement(c)
+		}
+
+		writeAXMLNode(&body, resXMLEndElement, el.line, []uint32{ns, name})
+
+		for i := len(el.namespaces) - 1; i >= 0; i-- {
+			ns := el.namespaces[i]
+			writeAXMLNode(&body, resXMLEndNamespace, el.line, []uint32{pool.indexOf(ns.prefix), pool.indexOf(ns.uri)})
+		}
+	}
+	writeElement(root)
+
+	var resMap bytes.Buffer
+	binary.Write(&resMap, binary.LittleEndian, []uint16{resXMLResourceMapType, 8})
+	binary.Write(&resMap, binary.LittleEndian, uint32(8+4*len(resIDs)))
+	binary.Write(&resMap, binary.LittleEndian, resIDs)
+
+	stringPool, err := pool.encode(false)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, []uint16{resXMLType, 8})
+	binary.Write(&out, binary.LittleEndian, uint32(8+len(stringPool)+resMap.Len()+body.Len()))
+	out.Write(stringPool)
+	out.Write(resMap.Bytes())
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
+
+// splitManifestXML is the manifest of a configuration split, which must match the base's
+// versionCode. Those of feature modules are configForSplit their module.
+func splitManifestXML(pkg string, versionCode int, split string, configForSplit string) ([]byte, error) {
+	manifest := &axmlElement{
+		namespaces: []axmlNamespaceDecl{{"android", axmlNamespace}},
+		name:       "manifest",
+		attrs: []axmlAttr{
+			axmlAndroidInt(0x0101021b, "versionCode", versionCode),
+			axmlString("package", pkg),
+			axmlString("split", split),
+		},
+		children: []*axmlElement{{
+			name: "application",
+			attrs: []axmlAttr{
+				axmlAndroidBool(0x0101000c, "hasCode", false),
+			},
+		}},
+	}
+	if configForSplit != "" {
+		manifest.setAttr(axmlString("configForSplit", configForSplit))
+	}
+
+	return encodeAXML(manifest)
+}
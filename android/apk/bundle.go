@@ -0,0 +1,301 @@
+package repo
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Extensions of split APK bundle archives: bundletool's .apks, .xapk, and APKMirror's .apkm.
+var bundleExts = map[string]bool{
+	".apks": true,
+	".apkm": true,
+	".xapk": true,
+}
+
+func isBundle(path string) bool {
+	return bundleExts[strings.ToLower(filepath.Ext(path))]
+}
+
+type xapkManifest struct {
+	PackageName string `json:"package_name"`
+	SplitApks   []struct {
+		File string `json:"file"`
+		ID   string `json:"id"`
+	} `json:"split_apks"`
+}
+
+// Fields of bundletool's BuildApksResult (commands.proto)
+const (
+	tocVariant       = 1
+	tocAssetSliceSet = 3
+
+	tocVariantTargeting = 1
+	tocVariantApkSet    = 2
+
+	tocApkSetModule      = 1
+	tocApkSetDescription = 2
+
+	// Of ModuleMetadata, and AssetModuleMetadata
+	tocModuleDelivery      = 6
+	tocAssetModuleDelivery = 4
+
+	tocApkPath  = 2
+	tocApkSplit = 3
+
+	tocInstallTime = 1
+)
+
+// tocVariantMinSdk is the minimum SDK version of a variant, 0 if it has none.
+func tocVariantMinSdk(variant pbMessage) uint64 {
+	// VariantTargeting.sdk_version_targeting.value[0].min.value
+	if min, ok := variant.message(tocVariantTargeting, 1, 1, 1); ok {
+		return min.uint(1)
+	}
+	return 0
+}
+
+// tocInstalledAtInstallTime reports whether a module of ModuleMetadata or AssetModuleMetadata
+// is installed with the app, by its delivery_type field, or else the deprecated on_demand.
+func tocInstalledAtInstallTime(module pbMessage, deliveryType protowire.Number) bool {
+	if module.str(1) == "base" {
+		return true
+	}
+	if delivery := module.uint(deliveryType); delivery != 0 {
+		return delivery == tocInstallTime
+	}
+	return module.uint(2) == 0
+}
+
+// tocApkNames lists the split APKs of the base, and feature and asset modules installed with it,
+// in bundletool's table of contents. Of several variants of split APKs, that for the oldest
+// Android is used, as it's not known which the device supports.
+func tocApkNames(data []byte) ([]string, error) {
+	toc, err := parsePB(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var variant *pbMessage
+	for _, v := range toc.messages(tocVariant) {
+		v := v
+		hasSplits := false
+		for _, apkSet := range v.messages(tocVariantApkSet) {
+			for _, apk := range apkSet.messages(tocApkSetDescription) {
+				hasSplits = hasSplits || apk.has(tocApkSplit)
+			}
+		}
+
+		if hasSplits && (variant == nil || tocVariantMinSdk(v) < tocVariantMinSdk(*variant)) {
+			variant = &v
+		}
+	}
+	if variant == nil {
+		return nil, nil
+	}
+
+	var names []string
+	hasBase := false
+	for _, apkSet := range variant.messages(tocVariantApkSet) {
+		module, _ := apkSet.message(tocApkSetModule)
+		if !tocInstalledAtInstallTime(module, tocModuleDelivery) {
+			log.Printf("[INFO] Not installing module %s, which isn't delivered at install time", module.str(1))
+			continue
+		}
+		hasBase = hasBase || module.str(1) == "base"
+
+		for _, apk := range apkSet.messages(tocApkSetDescription) {
+			if apk.has(tocApkSplit) {
+				names = append(names, apk.str(tocApkPath))
+			}
+		}
+	}
+	if !hasBase {
+		return nil, fmt.Errorf("no base module")
+	}
+
+	for _, assets := range toc.messages(tocAssetSliceSet) {
+		module, _ := assets.message(1)
+		if !tocInstalledAtInstallTime(module, tocAssetModuleDelivery) {
+			log.Printf("[INFO] Not installing asset pack %s, which isn't delivered at install time", module.str(1))
+			continue
+		}
+
+		for _, apk := range assets.messages(tocApkSetDescription) {
+			names = append(names, apk.str(tocApkPath))
+		}
+	}
+
+	return names, nil
+}
+
+// bundleApkNames lists the archive members to install, according to whichever index file
+// identifies the format; a plain zip of APKs has none.
+func bundleApkNames(zr *zip.Reader) ([]string, error) {
+	files := make(map[string]bool)
+	for _, f := range zr.File {
+		files[f.Name] = true
+	}
+
+	var names []string
+	switch {
+	case files["toc.pb"]:
+		// bundletool: the split set is listed in its table of contents, otherwise there's a universal.apk
+		toc, err := readZipEntry(zr, "toc.pb")
+		if err != nil {
+			return nil, err
+		}
+		if names, err = tocApkNames(toc); err != nil {
+			return nil, fmt.Errorf("invalid .apks toc.pb: %s", err)
+		}
+		if len(names) == 0 && files["universal.apk"] {
+			names = []string{"universal.apk"}
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("only split and universal .apks are supported, not standalone APKs")
+		}
+
+	case files["manifest.json"]:
+		data, err := readZipEntry(zr, "manifest.json")
+		if err != nil {
+			return nil, err
+		}
+
+		var manifest xapkManifest
+		if err = json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("invalid .xapk manifest.json: %s", err)
+		}
+
+		for _, split := range manifest.SplitApks {
+			names = append(names, split.File)
+		}
+		if len(names) == 0 {
+			names = []string{fmt.Sprintf("%s.apk", manifest.PackageName)}
+		}
+		for name := range files {
+			if strings.HasPrefix(name, "Android/obb/") {
+				log.Printf("[WARN] Ignoring OBB expansion file %s in %s bundle", name, manifest.PackageName)
+			}
+		}
+
+	default:
+		// info.json of .apkm is only metadata, its APKs are at the root like a plain zip
+		for _, f := range zr.File {
+			if !f.FileInfo().IsDir() && path.Ext(f.Name) == ".apk" {
+				names = append(names, f.Name)
+			}
+		}
+	}
+
+	for _, name := range names {
+		if !files[name] {
+			return nil, fmt.Errorf("%s listed but missing", name)
+		}
+	}
+
+	return names, nil
+}
+
+// unpackBundle extracts the APKs to install from a bundle archive, or zip of APKs, into dir.
+func unpackBundle(archivePath string, dir string) ([]string, error) {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	names, err := bundleApkNames(&zr.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %s", archivePath, err)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No APKs found in %s", archivePath)
+	}
+
+	if err = os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	var paths []string
+	for _, f := range zr.File {
+		if !wanted[f.Name] {
+			continue
+		}
+
+		dest := filepath.Join(dir, path.Base(f.Name))
+		if err = unzipFile(f, dest); err != nil {
+			return nil, fmt.Errorf("Failed to extract %s: %s", f.Name, err)
+		}
+		paths = append(paths, dest)
+	}
+
+	return paths, nil
+}
+
+// unpackLocalBundle extracts a bundle into the cache, keyed by its content.
+func unpackLocalBundle(archivePath string, limits CacheLimits) ([]string, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	source := fmt.Sprintf("bundle:%x", h.Sum(nil))
+	if paths, ok, err := cachedBySource(source); err != nil || ok {
+		return paths, err
+	}
+
+	stagingDir, err := cacheStagingDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	paths, err := unpackBundle(archivePath, stagingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return cacheStore(paths, source, limits)
+}
+
+func unzipFile(f *zip.File, dest string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, rc)
+	return err
+}
@@ -0,0 +1,206 @@
+package repo
+
+import (
+	"archive/zip"
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tocTestApkSet is an ApkSet of bundletool's toc.pb, of the module with the given delivery
+// type (0 for none), with an APK at each path.
+func tocTestApkSet(module string, delivery uint64, paths ...string) []byte {
+	metadata := [][]byte{pbTestString(1, module)}
+	if delivery != 0 {
+		metadata = append(metadata, pbTestVarint(tocModuleDelivery, delivery))
+	}
+
+	fields := [][]byte{pbTestMessage(tocApkSetModule, metadata...)}
+	for _, path := range paths {
+		fields = append(fields, pbTestMessage(tocApkSetDescription, pbTestString(tocApkPath, path), pbTestMessage(tocApkSplit)))
+	}
+	return pbTestMessage(tocVariantApkSet, fields...)
+}
+
+// tocTestVariant is a Variant of bundletool's toc.pb, for devices from minSdk.
+func tocTestVariant(minSdk uint64, apkSets ...[]byte) []byte {
+	targeting := pbTestMessage(tocVariantTargeting, pbTestMessage(1, pbTestMessage(1, pbTestMessage(1, pbTestVarint(1, minSdk)))))
+	return pbTestMessage(tocVariant, append([][]byte{targeting}, apkSets...)...)
+}
+
+func TestBundleApkNames(t *testing.T) {
+	const installTime, onDemand = 1, 2
+
+	toc := func(fields ...[]byte) []byte { return bytes.Join(fields, nil) }
+
+	for _, tc := range []struct {
+		name  string
+		files map[string][]byte
+		want  []string
+		err   string
+	}{
+		{
+			name: "apks",
+			files: map[string][]byte{
+				"toc.pb": toc(
+					tocTestVariant(31, tocTestApkSet("base", 0, "splits/base-master_2.apk")),
+					tocTestVariant(21,
+						tocTestApkSet("base", 0, "splits/base-master.apk", "splits/base-arm64_v8a.apk"),
+						tocTestApkSet("feature", installTime, "splits/feature-master.apk"),
+						tocTestApkSet("ondemand", onDemand, "splits/ondemand-master.apk"),
+					),
+					pbTestMessage(tocAssetSliceSet, pbTestMessage(1, pbTestString(1, "assets"), pbTestVarint(tocAssetModuleDelivery, installTime)), pbTestMessage(tocApkSetDescription, pbTestString(tocApkPath, "asset-slices/assets-master.apk"))),
+					pbTestMessage(tocAssetSliceSet, pbTestMessage(1, pbTestString(1, "later"), pbTestVarint(tocAssetModuleDelivery, onDemand)), pbTestMessage(tocApkSetDescription, pbTestString(tocApkPath, "asset-slices/later-master.apk"))),
+				),
+				"splits/base-master.apk":         nil,
+				"splits/base-master_2.apk":       nil,
+				"splits/base-arm64_v8a.apk":      nil,
+				"splits/feature-master.apk":      nil,
+				"splits/ondemand-master.apk":     nil,
+				"asset-slices/assets-master.apk": nil,
+				"asset-slices/later-master.apk":  nil,
+			},
+			want: []string{"splits/base-master.apk", "splits/base-arm64_v8a.apk", "splits/feature-master.apk", "asset-slices/assets-master.apk"},
+		},
+		{
+			name: "universal apks",
+			files: map[string][]byte{
+				"toc.pb":        toc(pbTestMessage(tocVariant, pbTestMessage(tocVariantApkSet, pbTestMessage(tocApkSetModule, pbTestString(1, "base")), pbTestMessage(tocApkSetDescription, pbTestString(tocApkPath, "universal.apk"))))),
+				"universal.apk": nil,
+			},
+			want: []string{"universal.apk"},
+		},
+		{
+			name: "standalone apks",
+			files: map[string][]byte{
+				"toc.pb":                               toc(pbTestMessage(tocVariant, pbTestMessage(tocVariantApkSet, pbTestMessage(tocApkSetModule, pbTestString(1, "base")), pbTestMessage(tocApkSetDescription, pbTestString(tocApkPath, "standalones/standalone-arm64_v8a.apk"))))),
+				"standalones/standalone-arm64_v8a.apk": nil,
+			},
+			err: "only split and universal .apks are supported, not standalone APKs",
+		},
+		{
+			name: "apks without base",
+			files: map[string][]byte{
+				"toc.pb":                    toc(tocTestVariant(21, tocTestApkSet("feature", installTime, "splits/feature-master.apk"))),
+				"splits/feature-master.apk": nil,
+			},
+			err: "invalid .apks toc.pb: no base module",
+		},
+		{
+			name: "apks missing a split",
+			files: map[string][]byte{
+				"toc.pb":                 toc(tocTestVariant(21, tocTestApkSet("base", 0, "splits/base-master.apk", "splits/base-xxhdpi.apk"))),
+				"splits/base-master.apk": nil,
+			},
+			err: "splits/base-xxhdpi.apk listed but missing",
+		},
+		{
+			name: "xapk",
+			files: map[string][]byte{
+				"manifest.json":                     []byte(`{"package_name": "org.example.app", "split_apks": [{"file": "org.example.app.apk", "id": "base"}, {"file": "config.arm64_v8a.apk", "id": "config.arm64_v8a"}]}`),
+				"org.example.app.apk":               nil,
+				"config.arm64_v8a.apk":              nil,
+				"config.x86_64.apk":                 nil,
+				"icon.png":                          nil,
+				"Android/obb/org.example.app/a.obb": nil,
+			},
+			want: []string{"org.example.app.apk", "config.arm64_v8a.apk"},
+		},
+		{
+			name: "xapk of one APK",
+			files: map[string][]byte{
+				"manifest.json":       []byte(`{"package_name": "org.example.app"}`),
+				"org.example.app.apk": nil,
+			},
+			want: []string{"org.example.app.apk"},
+		},
+		{
+			name:  "invalid xapk",
+			files: map[string][]byte{"manifest.json": []byte(`[]`)},
+			err:   "invalid .xapk manifest.json: json: cannot unmarshal array into Go value of type repo.xapkManifest",
+		},
+		{
+			name: "apkm",
+			files: map[string][]byte{
+				"info.json":                  []byte(`{"pname": "org.example.app"}`),
+				"base.apk":                   nil,
+				"split_config.arm64_v8a.apk": nil,
+				"icon.png":                   nil,
+			},
+			want: []string{"base.apk", "split_config.arm64_v8a.apk"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := testArchive(t, tc.files)
+			zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names, err := bundleApkNames(zr)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("Got error %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := append([]string{}, names...)
+			want := append([]string{}, tc.want...)
+			sort.Strings(got)
+			sort.Strings(want)
+			if !equalStrings(got, want) {
+				t.Errorf("Got %v, want %v", names, tc.want)
+			}
+		})
+	}
+}
+
+func TestLocalBundle(t *testing.T) {
+	useTestCache(t)
+	apks := testSplitApks(t, testSigningKey(t))
+
+	files := map[string][]byte{"manifest.json": []byte(`{"package_name": "org.example.app", "split_apks": [` +
+		`{"file": "org.example.app.apk", "id": "base"}, {"file": "config.arm64_v8a.apk", "id": "config.arm64_v8a"}]}`)}
+	for name, data := range apks {
+		if name == "base" {
+			name = "org.example.app"
+		}
+		files[name+".apk"] = data
+	}
+
+	path := filepath.Join(t.TempDir(), "org.example.app.XAPK")
+	if err := writeFileDataAtomic(path, testArchive(t, files)); err != nil {
+		t.Fatal(err)
+	}
+
+	var cached []string
+	for i := 0; i < 2; i++ {
+		pkg, err := Package([]string{"local"}, "org.example.app", Options{Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths, err := pkg.GetApkPaths(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if version, err := Version(pkg); err != nil || version != 42 {
+			t.Errorf("Got versionCode %d (%v), want 42", version, err)
+		}
+		if len(paths) != 2 || *pkg.Apk().BasePath != paths[0] || !strings.HasSuffix(paths[1], "arm64_v8a.apk") {
+			t.Errorf("Got %v, want the base and listed split, base first", paths)
+		}
+
+		if cached == nil {
+			cached = paths
+		} else if !equalStrings(paths, cached) {
+			t.Errorf("Unpacked again to %v, rather than reusing %v", paths, cached)
+		}
+	}
+}
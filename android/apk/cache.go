@@ -0,0 +1,485 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adrg/xdg"
+	aapt "github.com/shogo82148/androidbinary/apk"
+)
+
+// The APKs acquired by every method share a cache, keyed by package, versionCode, signer, and
+// split set, so that different versions, signers, and sets of splits (e.g. for different ABIs)
+// can coexist. APKs that differ in content from the entry of their key (e.g. rebuilt without
+// bumping versionCode) are added as another entry, keyed also by their content.
+
+// CacheLimits bounds the APK cache. Zero values mean no limit.
+type CacheLimits struct {
+	// Total size in bytes, beyond which the least recently used APKs are evicted
+	MaxSize int64
+	// Time since last use after which APKs are evicted
+	MaxAge time.Duration
+}
+
+// Entries used by this process, or recently by another (e.g. a concurrent `terraform apply`
+// between plan and install), are never evicted, since they may yet be installed
+var processStart = time.Now()
+
+const cacheUseGrace = 24 * time.Hour
+
+type cacheEntry struct {
+	Package     string `json:"package"`
+	VersionCode int    `json:"versionCode"`
+	// Hex-encoded SHA-256 of the base APK's signing certificate, or empty if unsigned
+	Signer string   `json:"signer"`
+	Splits []string `json:"splits"`
+	// Relative to the cache directory, base APK first
+	Files []string `json:"files"`
+	// Hex-encoded SHA-256 of each of Files
+	Sha256s []string `json:"sha256s"`
+	// Acquirer-specific identifiers of where the APKs came from, e.g. the hash of a download;
+	// only recorded on the entry of what was acquired from them
+	Sources  []string  `json:"sources"`
+	Size     int64     `json:"size"`
+	Added    time.Time `json:"added"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+type cacheIndex struct {
+	Entries map[string]*cacheEntry `json:"entries"`
+}
+
+const cacheIndexName = "index.json"
+
+func apkCacheDir() (string, error) {
+	dir, err := xdg.CacheFile("terraform-android/apks")
+	if err != nil {
+		return "", err
+	}
+
+	return dir, os.MkdirAll(dir, 0775)
+}
+
+// lockCacheIndex serialises modifications of the index across processes, e.g. concurrent
+// `terraform apply`s, and must be held from loadCacheIndex to save.
+func lockCacheIndex(dir string) (func(), error) {
+	return lockFile(filepath.Join(dir, cacheIndexName))
+}
+
+func loadCacheIndex(dir string) (*cacheIndex, error) {
+	index := &cacheIndex{Entries: make(map[string]*cacheEntry)}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, cacheIndexName))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, index); err != nil {
+		log.Printf("[WARN] Ignoring corrupt APK cache index: %s", err)
+		return &cacheIndex{Entries: make(map[string]*cacheEntry)}, nil
+	}
+
+	if index.Entries == nil {
+		index.Entries = make(map[string]*cacheEntry)
+	}
+
+	return index, nil
+}
+
+func (index *cacheIndex) save(dir string) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileDataAtomic(filepath.Join(dir, cacheIndexName), data)
+}
+
+func (entry *cacheEntry) exists(dir string) bool {
+	for _, f := range entry.Files {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			return false
+		}
+	}
+	return len(entry.Files) > 0
+}
+
+// contentMatches is whether the entry's files have the given SHA-256s, in order.
+func (entry *cacheEntry) contentMatches(dir string, sums []string) bool {
+	// Entries cached before their content was recorded
+	if len(entry.Sha256s) != len(entry.Files) {
+		entry.Sha256s = nil
+		for _, path := range entry.paths(dir) {
+			sum, err := fileSha256(path)
+			if err != nil {
+				return false
+			}
+			entry.Sha256s = append(entry.Sha256s, sum)
+		}
+	}
+
+	return strings.Join(entry.Sha256s, ",") == strings.Join(sums, ",")
+}
+
+func (entry *cacheEntry) paths(dir string) []string {
+	var paths []string
+	for _, f := range entry.Files {
+		paths = append(paths, filepath.Join(dir, f))
+	}
+	return paths
+}
+
+// evictionLimits are those enforced as the APKs of apk are cached: none offline, since nothing
+// evicted could be acquired again.
+func (apk *Apk) evictionLimits() CacheLimits {
+	if apk.Offline {
+		return CacheLimits{}
+	}
+	return apk.CacheLimits
+}
+
+// evict removes entries unused for longer than MaxAge, and then the least recently used until
+// the cache fits in MaxSize.
+func (index *cacheIndex) evict(dir string, limits CacheLimits) {
+	var keys []string
+	var total int64
+	for key, entry := range index.Entries {
+		keys = append(keys, key)
+		total += entry.Size
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return index.Entries[keys[i]].LastUsed.Before(index.Entries[keys[j]].LastUsed)
+	})
+
+	for _, key := range keys {
+		entry := index.Entries[key]
+		if !entry.LastUsed.Before(processStart) || time.Since(entry.LastUsed) < cacheUseGrace {
+			break
+		}
+
+		expired := limits.MaxAge > 0 && time.Since(entry.LastUsed) > limits.MaxAge
+		oversize := limits.MaxSize > 0 && total > limits.MaxSize
+		if !expired && !oversize {
+			continue
+		}
+
+		log.Printf("[INFO] Evicting %s @ %d from APK cache, last used %s", entry.Package, entry.VersionCode, entry.LastUsed)
+		if err := os.RemoveAll(filepath.Join(dir, filepath.Dir(entry.Files[0]))); err != nil {
+			log.Printf("[WARN] Failed to evict %s @ %d: %s", entry.Package, entry.VersionCode, err)
+			continue
+		}
+
+		// Only succeeds if that was the package's last entry
+		os.Remove(filepath.Join(dir, entry.Package))
+
+		total -= entry.Size
+		delete(index.Entries, key)
+	}
+}
+
+// cacheLookup returns the paths of the cached APKs that match, of the highest versionCode and the
+// most recently used of those.
+func cacheLookup(match func(*cacheEntry) bool) ([]string, bool, error) {
+	dir, err := apkCacheDir()
+	if err != nil {
+		return nil, false, err
+	}
+
+	unlock, err := lockCacheIndex(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+
+	index, err := loadCacheIndex(dir)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var found *cacheEntry
+	for _, entry := range index.Entries {
+		if !entry.exists(dir) || !match(entry) {
+			continue
+		}
+
+		if found == nil || entry.VersionCode > found.VersionCode ||
+			(entry.VersionCode == found.VersionCode && entry.LastUsed.After(found.LastUsed)) {
+			found = entry
+		}
+	}
+
+	if found == nil {
+		return nil, false, nil
+	}
+
+	found.LastUsed = time.Now()
+	if err = index.save(dir); err != nil {
+		return nil, false, err
+	}
+
+	log.Printf("[DEBUG] Found %s @ %d in APK cache", found.Package, found.VersionCode)
+	return found.paths(dir), true, nil
+}
+
+// cachedBySource returns the cached APKs previously stored from source.
+func cachedBySource(source string) ([]string, bool, error) {
+	return cacheLookup(func(entry *cacheEntry) bool {
+		for _, s := range entry.Sources {
+			if s == source {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// cachedByVersion returns cached APKs of apk's package at versionCode, from any source. Those
+// planned to be installed are picked by their SHA-256, or else signer, since there may be other
+// builds of the version; it's an error if that's unknown and there are several.
+func cachedByVersion(apk *Apk, versionCode int) ([]string, bool, error) {
+	dir, err := apkCacheDir()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var matches int
+	var matchErr error
+	paths, ok, err := cacheLookup(func(entry *cacheEntry) bool {
+		if entry.Package != apk.Name || entry.VersionCode != versionCode {
+			return false
+		}
+
+		switch {
+		case apk.PlannedSha256 != "":
+			sum, _, err := apksSha256(entry.paths(dir))
+			if err != nil {
+				matchErr = err
+				return false
+			}
+			if sum != apk.PlannedSha256 {
+				return false
+			}
+		case apk.PlannedSigner != "":
+			if entry.Signer != normaliseFingerprint(apk.PlannedSigner) {
+				return false
+			}
+		}
+
+		matches++
+		return true
+	})
+	if err == nil {
+		err = matchErr
+	}
+	if err == nil && matches > 1 {
+		err = fmt.Errorf("%d different builds of %s @ %d are cached, and which was planned is unknown", matches, apk.Name, versionCode)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return paths, ok, nil
+}
+
+// cacheStagingDir is a temporary directory in which to acquire APKs before cacheStore, on the
+// same filesystem so that they can be moved rather than copied. Callers should remove it.
+func cacheStagingDir() (string, error) {
+	dir, err := apkCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return ioutil.TempDir(dir, ".staging-")
+}
+
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	return copyFile(src, dst)
+}
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return writeFileAtomic(dst, func(out io.Writer) error {
+		_, err := io.Copy(out, in)
+		return err
+	})
+}
+
+// cacheStore moves the (split) APKs at paths into the cache, recording source (if not empty)
+// for cachedBySource, and returns their paths in the cache, base APK first. If they're already
+// cached, those paths are returned instead. Then whatever's beyond limits is evicted.
+func cacheStore(paths []string, source string, limits CacheLimits) ([]string, error) {
+	basePath, err := findBaseApk(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := aapt.OpenFile(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %s", basePath, err)
+	}
+	pkg := base.PackageName()
+	versionCode, err := base.Manifest().VersionCode.Int32()
+	base.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s versionCode: %s", basePath, err)
+	}
+
+	var signer string
+	if _, certs, err := ApkSigners(basePath); err == nil {
+		signer = certFingerprint(certs[0])
+	} else {
+		log.Printf("[WARN] Caching %s, which has no valid signature: %s", basePath, err)
+	}
+
+	files := map[string]string{"base.apk": basePath}
+	var splits []string
+	for _, path := range paths {
+		if path == basePath {
+			continue
+		}
+
+		split := splitName(path)
+		if _, ok := files["split_"+split+".apk"]; ok || split == "" {
+			return nil, fmt.Errorf("Duplicate split %q of %s", split, pkg)
+		}
+		files["split_"+split+".apk"] = path
+		splits = append(splits, split)
+	}
+	sort.Strings(splits)
+
+	names := []string{"base.apk"}
+	for _, split := range splits {
+		names = append(names, "split_"+split+".apk")
+	}
+
+	var sums []string
+	for _, name := range names {
+		sum, err := fileSha256(files[name])
+		if err != nil {
+			return nil, err
+		}
+		sums = append(sums, sum)
+	}
+
+	keySum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%s\n%s", pkg, versionCode, signer, strings.Join(splits, ","))))
+	key := hex.EncodeToString(keySum[:])
+
+	dir, err := apkCacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockCacheIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	index, err := loadCacheIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, ok := index.Entries[key]
+	if ok && entry.exists(dir) && !entry.contentMatches(dir, sums) {
+		contentSum := sha256.Sum256([]byte(key + "\n" + strings.Join(sums, ",")))
+		key = hex.EncodeToString(contentSum[:])
+		log.Printf("[WARN] %s @ %d differs from what's cached of the same version, caching it too", pkg, versionCode)
+
+		entry, ok = index.Entries[key]
+	}
+
+	if !ok || !entry.exists(dir) {
+		entryDir := filepath.Join(pkg, fmt.Sprintf("%d-%s", versionCode, key[:16]))
+		if err = os.MkdirAll(filepath.Join(dir, entryDir), 0775); err != nil {
+			return nil, err
+		}
+
+		entry = &cacheEntry{
+			Package:     pkg,
+			VersionCode: int(versionCode),
+			Signer:      signer,
+			Splits:      splits,
+			Sha256s:     sums,
+			Added:       time.Now(),
+		}
+
+		for _, name := range names {
+			dst := filepath.Join(entryDir, name)
+			if err = moveFile(files[name], filepath.Join(dir, dst)); err != nil {
+				return nil, fmt.Errorf("Failed to cache %s: %s", files[name], err)
+			}
+
+			stat, err := os.Stat(filepath.Join(dir, dst))
+			if err != nil {
+				return nil, err
+			}
+
+			entry.Files = append(entry.Files, dst)
+			entry.Size += stat.Size()
+		}
+
+		index.Entries[key] = entry
+		log.Printf("[INFO] Cached %s @ %d (%d splits)", pkg, versionCode, len(splits))
+	}
+
+	if source != "" {
+		// It's now known to provide this content, not whatever it did before
+		for _, other := range index.Entries {
+			var sources []string
+			for _, s := range other.Sources {
+				if s != source {
+					sources = append(sources, s)
+				}
+			}
+			other.Sources = sources
+		}
+		entry.Sources = append(entry.Sources, source)
+	}
+
+	entry.LastUsed = time.Now()
+	index.evict(dir, limits)
+
+	if err = index.save(dir); err != nil {
+		return nil, err
+	}
+
+	return entry.paths(dir), nil
+}
@@ -0,0 +1,148 @@
+package repo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+// useTestCache points the APK cache at a temporary directory, for the rest of the test.
+func useTestCache(t *testing.T) {
+	cacheHome := os.Getenv("XDG_CACHE_HOME")
+	os.Setenv("XDG_CACHE_HOME", t.TempDir())
+	xdg.Reload()
+
+	t.Cleanup(func() {
+		os.Setenv("XDG_CACHE_HOME", cacheHome)
+		xdg.Reload()
+	})
+}
+
+// testCacheApks caches the split APKs of testSplitApks signed by key, returning their paths in
+// the cache.
+func testCacheApks(t *testing.T, key *SigningKey) []string {
+	dir := t.TempDir()
+	var paths []string
+	for name, data := range testSplitApks(t, key) {
+		path := filepath.Join(dir, name+".apk")
+		if err := ioutil.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	paths, err := cacheStore(paths, "", CacheLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestCachedByVersion(t *testing.T) {
+	useTestCache(t)
+
+	keyA, keyB := testSigningKey(t), testSigningKey(t)
+	pathsA, pathsB := testCacheApks(t, keyA), testCacheApks(t, keyB)
+	sumB, _, err := apksSha256(pathsB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		apk     Apk
+		version int
+		want    []string
+		err     string
+	}{
+		{name: "ambiguous", apk: Apk{Name: "org.example.app"}, version: 42, err: "2 different builds of org.example.app @ 42 are cached, and which was planned is unknown"},
+		{name: "by signer", apk: Apk{Name: "org.example.app", PlannedSigner: strings.ToUpper(certFingerprint(keyA.Cert))}, version: 42, want: pathsA},
+		{name: "by sha256", apk: Apk{Name: "org.example.app", PlannedSha256: sumB}, version: 42, want: pathsB},
+		{name: "other signer", apk: Apk{Name: "org.example.app", PlannedSigner: strings.Repeat("0", 64)}, version: 42},
+		{name: "other version", apk: Apk{Name: "org.example.app", PlannedSigner: certFingerprint(keyA.Cert)}, version: 43},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			paths, ok, err := cachedByVersion(&tc.apk, tc.version)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("Got error %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok != (tc.want != nil) || !equalStrings(paths, tc.want) {
+				t.Errorf("Found %v (%v), want %v", paths, ok, tc.want)
+			}
+		})
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	day := 24 * time.Hour
+	// Sizes of 100 each, by how long ago they were last used
+	lastUsed := map[string]time.Time{
+		"old":     processStart.Add(-30 * day),
+		"stale":   processStart.Add(-3 * day),
+		"recent":  processStart.Add(-time.Hour),
+		"current": time.Now(),
+	}
+
+	for _, tc := range []struct {
+		name   string
+		apk    Apk
+		remain []string
+	}{
+		{name: "unlimited", remain: []string{"current", "old", "recent", "stale"}},
+		{name: "max age", apk: Apk{CacheLimits: CacheLimits{MaxAge: 7 * day}}, remain: []string{"current", "recent", "stale"}},
+		{name: "max age within grace", apk: Apk{CacheLimits: CacheLimits{MaxAge: time.Minute}}, remain: []string{"current", "recent"}},
+		{name: "max size", apk: Apk{CacheLimits: CacheLimits{MaxSize: 300}}, remain: []string{"current", "recent", "stale"}},
+		{name: "max size within grace", apk: Apk{CacheLimits: CacheLimits{MaxSize: 1}}, remain: []string{"current", "recent"}},
+		{name: "offline", apk: Apk{Offline: true, CacheLimits: CacheLimits{MaxAge: time.Minute, MaxSize: 1}}, remain: []string{"current", "old", "recent", "stale"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			index := &cacheIndex{Entries: make(map[string]*cacheEntry)}
+			for name, used := range lastUsed {
+				file := filepath.Join("org.example.app", name, "base.apk")
+				if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(file)), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, file), nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				index.Entries[name] = &cacheEntry{Package: "org.example.app", Files: []string{file}, Size: 100, LastUsed: used}
+			}
+
+			index.evict(dir, tc.apk.evictionLimits())
+
+			var remain []string
+			for name, entry := range index.Entries {
+				remain = append(remain, name)
+				if !entry.exists(dir) {
+					t.Errorf("Kept %s in the index, but removed its files", name)
+				}
+			}
+			sort.Strings(remain)
+			if !equalStrings(remain, tc.remain) {
+				t.Errorf("Kept %v, want %v", remain, tc.remain)
+			}
+
+			for name := range lastUsed {
+				if _, ok := index.Entries[name]; !ok {
+					if _, err := os.Stat(filepath.Join(dir, "org.example.app", name)); !os.IsNotExist(err) {
+						t.Errorf("Evicted %s from the index, but not its files", name)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package repo
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mvdan.cc/fdroidcl/adb"
+)
+
+// DevicePackage copies the APKs of a package installed on a reference device.
+type DevicePackage struct {
+	apk    *Apk
+	source *adb.Device
+}
+
+func init() {
+	RegisterMethod("device", func(apk *Apk, opts Options) APKAcquirer {
+		var source string
+		if opts.SourceDevice != nil {
+			source = opts.SourceDevice.ID
+		}
+		return RefreshedPackage{DevicePackage{apk, opts.SourceDevice}, fmt.Sprintf("device %s", source), opts.RefreshInterval}
+	})
+}
+
+func (pkg DevicePackage) Apk() *Apk {
+	return pkg.apk
+}
+
+func (pkg DevicePackage) GetApkPaths(device *adb.Device, _ *int) ([]string, error) {
+	if pkg.Apk().Paths == nil {
+		if err := pkg.UpdateCache(device); err != nil {
+			return nil, err
+		}
+	}
+
+	return pkg.Apk().Paths, nil
+}
+
+func (pkg DevicePackage) remotePaths() ([]string, error) {
+	cmd := pkg.source.AdbShell("pm", "path", pkg.apk.Name)
+	stdouterr, err := cmd.CombinedOutput()
+	log.Println(string(stdouterr))
+
+	var paths []string
+	for _, line := range strings.Split(string(stdouterr), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "package:") {
+			paths = append(paths, strings.TrimPrefix(line, "package:"))
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s is not installed on source device %s: %s", pkg.apk.Name, pkg.source.ID, stdouterr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find %s on source device %s: %s", pkg.apk.Name, pkg.source.ID, stdouterr)
+	}
+
+	return paths, nil
+}
+
+func (pkg DevicePackage) UpdateCache(_ *adb.Device) error {
+	if pkg.apk.Offline {
+		return updateFromCache(pkg.apk)
+	}
+
+	if pkg.source == nil {
+		return fmt.Errorf("source device required for %s", pkg.apk.Name)
+	}
+
+	remotePaths, err := pkg.remotePaths()
+	if err != nil {
+		return err
+	}
+
+	stagingDir, err := cacheStagingDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	var paths []string
+	for _, remotePath := range remotePaths {
+		localPath := filepath.Join(stagingDir, filepath.Base(remotePath))
+
+		log.Printf("[INFO] Pulling %s from %s", remotePath, pkg.source.ID)
+		cmd := pkg.source.AdbCmd("pull", remotePath, localPath)
+		stdouterr, err := cmd.CombinedOutput()
+		log.Println(string(stdouterr))
+		if err != nil {
+			return fmt.Errorf("Failed to retrieve %s from %s: %s", pkg.apk.Name, pkg.source.ID, stdouterr)
+		}
+
+		paths = append(paths, localPath)
+	}
+
+	if paths, err = cacheStore(paths, "", pkg.apk.evictionLimits()); err != nil {
+		return err
+	}
+
+	pkg.apk.BasePath = &paths[0]
+	pkg.apk.Paths = paths
+	return nil
+}
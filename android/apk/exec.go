@@ -0,0 +1,304 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	aapt "github.com/shogo82148/androidbinary/apk"
+	"mvdan.cc/fdroidcl/adb"
+)
+
+// ExecPackage acquires APKs by running a program, which is written a JSON execRequest on stdin,
+// and must write a JSON execResponse to stdout and exit 0. Anything it writes to stderr is logged.
+//
+// The APKs it returns, whether by path or URL, are copied into the cache; it needn't keep them.
+type ExecPackage struct {
+	apk     *Apk
+	command []string
+	// How long the program may run; zero means no limit
+	timeout time.Duration
+}
+
+type execRequest struct {
+	Package string `json:"package"`
+	// As `version_constraint` and `version_name_pattern` of the resource, or empty; if the
+	// version planned must be installed, this includes `= <versionCode>`
+	VersionConstraint  string     `json:"version_constraint"`
+	VersionNamePattern string     `json:"version_name_pattern"`
+	Device             execDevice `json:"device"`
+}
+
+type execDevice struct {
+	Serial   string   `json:"serial"`
+	Model    string   `json:"model"`
+	ABIs     []string `json:"abis"`
+	Density  int      `json:"density"`
+	Locales  []string `json:"locales"`
+	APILevel int      `json:"api_level"`
+}
+
+type execResponse struct {
+	// The base APK and any splits, each by one of path or URL
+	APKs []struct {
+		Path string `json:"path"`
+		URL  string `json:"url"`
+		// Hex-encoded, if set the download from URL must match it
+		Sha256 string `json:"sha256"`
+	} `json:"apks"`
+	// If set, checked against the APKs
+	VersionCode int    `json:"version_code"`
+	VersionName string `json:"version_name"`
+	// If set, acquisition failed
+	Error string `json:"error"`
+}
+
+func init() {
+	RegisterMethod("exec", func(apk *Apk, opts Options) APKAcquirer {
+		return RefreshedPackage{ExecPackage{apk, opts.Command, opts.ExecTimeout}, fmt.Sprintf("exec %q", opts.Command), opts.RefreshInterval}
+	})
+}
+
+func (pkg ExecPackage) Apk() *Apk {
+	return pkg.apk
+}
+
+func (pkg ExecPackage) GetApkPaths(device *adb.Device, version *int) ([]string, error) {
+	if pkg.Apk().Paths != nil {
+		return pkg.Apk().Paths, nil
+	}
+
+	if version == nil {
+		return nil, fmt.Errorf("version required")
+	}
+
+	paths, ok, err := cachedByVersion(pkg.apk, *version)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		// Install what was planned, if it's still available
+		pkg.apk.VersionFilter = pkg.apk.VersionFilter.WithVersionCode(*version)
+		if err = pkg.UpdateCache(device); err != nil {
+			return nil, err
+		}
+
+		if paths, ok, err = cachedByVersion(pkg.apk, *version); err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s didn't return the build of %s @ %d that was planned", pkg.command[0], pkg.apk.Name, *version)
+		}
+	}
+
+	pkg.apk.BasePath = &paths[0]
+	pkg.apk.Paths = paths
+	return pkg.apk.Paths, nil
+}
+
+func (pkg ExecPackage) request(device *adb.Device) (*execRequest, error) {
+	req := &execRequest{Package: pkg.apk.Name}
+
+	if filter := pkg.apk.VersionFilter; filter != nil {
+		req.VersionConstraint = filter.constraint
+		if filter.namePattern != nil {
+			req.VersionNamePattern = filter.namePattern.String()
+		}
+	}
+
+	if device != nil {
+		props, err := device.AdbProps()
+		if err != nil {
+			return nil, err
+		}
+		spec := DeviceSpecFromProps(props)
+
+		req.Device = execDevice{
+			Serial:   device.ID,
+			Model:    device.Model,
+			ABIs:     spec.ABIs,
+			Density:  spec.Density,
+			Locales:  spec.Locales,
+			APILevel: spec.APILevel,
+		}
+	}
+
+	return req, nil
+}
+
+func (pkg ExecPackage) run(device *adb.Device) (*execResponse, error) {
+	req, err := pkg.request(device)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdin, stdout, stderr bytes.Buffer
+	encoder := json.NewEncoder(&stdin)
+	encoder.SetEscapeHTML(false)
+	if err = encoder.Encode(req); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if pkg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pkg.timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, pkg.command[0], pkg.command[1:]...)
+	cmd.Stdin = &stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	setProcessGroup(cmd)
+
+	log.Printf("[INFO] Running %v for %s", pkg.command, pkg.apk.Name)
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to run %s for %s: %s", pkg.command[0], pkg.apk.Name, err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	close(exited)
+	log.Println(stderr.String())
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%s didn't acquire %s within %s", pkg.command[0], pkg.apk.Name, pkg.timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to run %s for %s: %s: %s", pkg.command[0], pkg.apk.Name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var resp execResponse
+	if err = json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("Invalid response from %s for %s: %s", pkg.command[0], pkg.apk.Name, err)
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s failed to acquire %s: %s", pkg.command[0], pkg.apk.Name, resp.Error)
+	}
+
+	if len(resp.APKs) == 0 {
+		return nil, fmt.Errorf("%s returned no APKs for %s", pkg.command[0], pkg.apk.Name)
+	}
+
+	return &resp, nil
+}
+
+func (pkg ExecPackage) UpdateCache(device *adb.Device) error {
+	if len(pkg.command) == 0 {
+		return fmt.Errorf("command required for %s", pkg.apk.Name)
+	}
+
+	if pkg.apk.Offline {
+		return updateFromCache(pkg.apk)
+	}
+
+	resp, err := pkg.run(device)
+	if err != nil {
+		return err
+	}
+
+	stagingDir, err := cacheStagingDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	var staged []string
+	for i, apk := range resp.APKs {
+		path := filepath.Join(stagingDir, fmt.Sprintf("%d.apk", i))
+
+		switch {
+		case apk.Path != "" && apk.URL == "":
+			if err = copyFile(apk.Path, path); err != nil {
+				return fmt.Errorf("Failed to copy %s: %s", apk.Path, err)
+			}
+		case apk.URL != "" && apk.Path == "":
+			var sum []byte
+			if apk.Sha256 != "" {
+				if sum, err = hex.DecodeString(strings.ToLower(apk.Sha256)); err != nil {
+					return fmt.Errorf("Invalid sha256 of %s: %s", apk.URL, err)
+				}
+			}
+
+			if err = downloadEtag(apk.URL, path, sum, pkg.apk.Offline); err != nil {
+				return fmt.Errorf("Failed to download %s: %s", pkg.apk.Name, err)
+			}
+		default:
+			return fmt.Errorf("%s returned an APK for %s without exactly one of path and url", pkg.command[0], pkg.apk.Name)
+		}
+
+		staged = append(staged, path)
+	}
+
+	if err = pkg.checkResponse(resp, staged); err != nil {
+		return err
+	}
+
+	paths, err := cacheStore(staged, "", pkg.apk.evictionLimits())
+	if err != nil {
+		return err
+	}
+
+	pkg.apk.BasePath = &paths[0]
+	pkg.apk.Paths = paths
+	return nil
+}
+
+// checkResponse fails if the APKs aren't of the package and version that the program said, or
+// of a version the resource allows.
+func (pkg ExecPackage) checkResponse(resp *execResponse, paths []string) error {
+	basePath, err := findBaseApk(paths)
+	if err != nil {
+		return err
+	}
+
+	base, err := aapt.OpenFile(basePath)
+	if err != nil {
+		return fmt.Errorf("Failed to read APK returned for %s: %s", pkg.apk.Name, err)
+	}
+	defer base.Close()
+
+	if name := base.PackageName(); name != pkg.apk.Name {
+		return fmt.Errorf("%s returned an APK of %s, not %s", pkg.command[0], name, pkg.apk.Name)
+	}
+
+	versionCode, err := base.Manifest().VersionCode.Int32()
+	if err != nil {
+		return err
+	}
+	if resp.VersionCode != 0 && int(versionCode) != resp.VersionCode {
+		return fmt.Errorf("%s returned %s @ %d, but said it was %d", pkg.command[0], pkg.apk.Name, versionCode, resp.VersionCode)
+	}
+
+	versionName, err := base.Manifest().VersionName.String()
+	if err != nil {
+		return err
+	}
+	if resp.VersionName != "" && versionName != resp.VersionName {
+		return fmt.Errorf("%s returned %s %s, but said it was %s", pkg.command[0], pkg.apk.Name, versionName, resp.VersionName)
+	}
+
+	if !pkg.apk.VersionFilter.Allows(int(versionCode), versionName) {
+		return fmt.Errorf("%s returned %s %s (%d), which does not satisfy %s", pkg.command[0], pkg.apk.Name, versionName, versionCode, pkg.apk.VersionFilter)
+	}
+
+	return nil
+}
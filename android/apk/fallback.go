@@ -0,0 +1,111 @@
+package repo
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"mvdan.cc/fdroidcl/adb"
+)
+
+// FallbackPackage tries several methods in order, acquiring the APKs from the first that has
+// a version allowed by the VersionFilter and Signers. Apk().Method is the one that did.
+type FallbackPackage struct {
+	apk        *Apk
+	methods    []string
+	acquirers  []APKAcquirer
+	preference string
+}
+
+func (pkg FallbackPackage) Apk() *Apk {
+	return pkg.apk
+}
+
+// ordered is the acquirers in the order to try, the preferred method first.
+func (pkg FallbackPackage) ordered() ([]string, []APKAcquirer) {
+	methods := []string{}
+	acquirers := []APKAcquirer{}
+	for i, method := range pkg.methods {
+		if method == pkg.preference {
+			methods = append([]string{method}, methods...)
+			acquirers = append([]APKAcquirer{pkg.acquirers[i]}, acquirers...)
+		} else {
+			methods = append(methods, method)
+			acquirers = append(acquirers, pkg.acquirers[i])
+		}
+	}
+	return methods, acquirers
+}
+
+func (pkg FallbackPackage) try(method string, acquire func() error) error {
+	pkg.apk.BasePath = nil
+	pkg.apk.Paths = nil
+
+	err := acquire()
+	if err == nil {
+		err = CheckVersion(pkg)
+	}
+	if err == nil {
+		err = CheckSigner(pkg)
+	}
+
+	if err != nil {
+		log.Printf("[WARN] Failed to acquire %s by %s: %s", pkg.apk.Name, method, err)
+		pkg.apk.BasePath = nil
+		pkg.apk.Paths = nil
+		return fmt.Errorf("%s: %s", method, err)
+	}
+
+	log.Printf("[INFO] Acquired %s by %s", pkg.apk.Name, method)
+	pkg.apk.Method = method
+	return nil
+}
+
+func (pkg FallbackPackage) UpdateCache(device *adb.Device) error {
+	var errs []string
+	methods, acquirers := pkg.ordered()
+	for i, acq := range acquirers {
+		err := pkg.try(methods[i], func() error {
+			return acq.UpdateCache(device)
+		})
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+
+	return fmt.Errorf("Failed to acquire %s by any method:\n%s", pkg.apk.Name, strings.Join(errs, "\n"))
+}
+
+func (pkg FallbackPackage) GetApkPaths(device *adb.Device, version *int) ([]string, error) {
+	if pkg.apk.Paths != nil {
+		return pkg.apk.Paths, nil
+	}
+
+	var errs []string
+	methods, acquirers := pkg.ordered()
+	for i, acq := range acquirers {
+		err := pkg.try(methods[i], func() error {
+			if _, err := acq.GetApkPaths(device, version); err != nil {
+				return err
+			}
+
+			if version == nil {
+				return nil
+			}
+
+			// Not all methods can be asked for a particular version
+			v, err := Version(acq)
+			if err == nil && v != *version {
+				err = fmt.Errorf("got version %d, not %d", v, *version)
+			}
+			return err
+		})
+		if err == nil {
+			return pkg.apk.Paths, nil
+		}
+		errs = append(errs, err.Error())
+	}
+
+	return nil, fmt.Errorf("Failed to acquire %s by any method:\n%s", pkg.apk.Name, strings.Join(errs, "\n"))
+}
@@ -0,0 +1,98 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFallbackPackage(t *testing.T) {
+	key := testSigningKey(t)
+	apk := testSplitApks(t, key)["base"]
+	path := writeTestApks(t, t.TempDir(), map[string][]byte{"base": apk})["base"]
+	sum := sha256.Sum256(apk)
+
+	var downloads int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write(apk)
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name       string
+		path       string
+		preference string
+		constraint string
+		signers    []string
+		version    *int
+		method     string
+		downloads  int
+		err        string
+	}{
+		{name: "first", path: path, method: "local"},
+		{name: "second", path: filepath.Join(t.TempDir(), "missing.apk"), method: "url", downloads: 1},
+		{name: "preferred", path: path, preference: "url", method: "url", downloads: 1},
+		{name: "preferred failing", path: path, preference: "url", constraint: "< 42", downloads: 1, err: "url: org.example.app  (42) does not satisfy versionCode < 42\nlocal: "},
+		{name: "version filter", path: path, constraint: "> 42", downloads: 1, err: "local: org.example.app  (42) does not satisfy versionCode > 42\nurl: "},
+		{name: "signer", path: path, signers: []string{strings.Repeat("0", 64)}, downloads: 1, err: "local: "},
+		{name: "version", path: path, version: new(int), downloads: 1, err: "local: got version 42, not 0\nurl: got version 42, not 0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestCache(t)
+			downloads = 0
+
+			filter, err := ParseVersionFilter(tc.constraint, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pkg, err := Package([]string{"local", "url"}, "org.example.app", Options{
+				Path:            tc.path,
+				URL:             srv.URL + "/app.apk",
+				Sha256:          fmt.Sprintf("%x", sum),
+				VersionFilter:   filter,
+				Signers:         tc.signers,
+				PreferredMethod: tc.preference,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var paths []string
+			if tc.version != nil {
+				paths, err = pkg.GetApkPaths(nil, tc.version)
+			} else if err = pkg.UpdateCache(nil); err == nil {
+				paths = pkg.Apk().Paths
+			}
+
+			if downloads != tc.downloads {
+				t.Errorf("Downloaded %d times, want %d", downloads, tc.downloads)
+			}
+			if tc.err != "" {
+				want := "Failed to acquire org.example.app by any method:\n"
+				if err == nil || !strings.HasPrefix(err.Error(), want) || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Got error %v, want %s%s", err, want, tc.err)
+				}
+				if pkg.Apk().Paths != nil {
+					t.Errorf("Kept the paths %v of a failed method", pkg.Apk().Paths)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pkg.Apk().Method != tc.method {
+				t.Errorf("Acquired by %s, want %s", pkg.Apk().Method, tc.method)
+			}
+			if len(paths) != 1 || (tc.method == "local") != (paths[0] == path) {
+				t.Errorf("Got %v from %s", paths, pkg.Apk().Method)
+			}
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package repo
 
 import (
+	"archive/zip"
 	"bytes"
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/adrg/xdg"
 	"io"
@@ -11,19 +14,84 @@ import (
 	"mvdan.cc/fdroidcl/adb"
 	"mvdan.cc/fdroidcl/fdroid"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+// FDroidRepo is an F-Droid repository, whose index must be signed by the key with Fingerprint.
+type FDroidRepo struct {
+	URL         string
+	Fingerprint string
+	Username    string
+	Password    string
+}
+
+var DefaultFDroidRepo = FDroidRepo{
+	URL:         "https://f-droid.org/repo",
+	Fingerprint: "43238d512c1e5eb2d6569f4a3afbf5523418b82e0a3ed1552770abb9a9c9ccab",
+}
+
+// fileURL is the URL of name in the repo, including any basic auth credentials.
+func (repo FDroidRepo) fileURL(name string) (string, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/%s", strings.TrimSuffix(repo.URL, "/"), name))
+	if err != nil {
+		return "", err
+	}
+
+	if repo.Username != "" {
+		u.User = url.UserPassword(repo.Username, repo.Password)
+	}
+
+	return u.String(), nil
+}
+
+func (repo FDroidRepo) cacheKey() string {
+	sum := sha256.Sum256([]byte(repo.URL))
+	return hex.EncodeToString(sum[:8])
+}
+
+// archive is the repo's archive of older versions, by F-Droid convention a sibling of `/repo`.
+func (repo FDroidRepo) archive() (FDroidRepo, bool) {
+	base := strings.TrimSuffix(repo.URL, "/")
+	if !strings.HasSuffix(base, "/repo") {
+		return FDroidRepo{}, false
+	}
+
+	archive := repo
+	archive.URL = fmt.Sprintf("%s/archive", strings.TrimSuffix(base, "/repo"))
+	return archive, true
+}
+
 type FDroidPackage struct {
-	apk *Apk
+	apk         *Apk
+	repos       []FDroidRepo
+	versionCode int
+	indices     *FDroidIndices
+}
+
+func init() {
+	RegisterMethod("fdroid", func(apk *Apk, opts Options) APKAcquirer {
+		var repos []string
+		for _, repo := range opts.FDroidRepos {
+			repos = append(repos, repo.URL)
+		}
+		return RefreshedPackage{FDroidPackage{apk, opts.FDroidRepos, opts.VersionCode, opts.FDroidIndices}, fmt.Sprintf("fdroid %d %v", opts.VersionCode, repos), opts.RefreshInterval}
+	})
 }
 
 func (pkg FDroidPackage) Apk() *Apk {
 	return pkg.apk
 }
 
-func (pkg FDroidPackage) GetApkPaths(device *adb.Device, _ *int) ([]string, error) {
+func (pkg FDroidPackage) GetApkPaths(device *adb.Device, version *int) ([]string, error) {
 	if pkg.Apk().Paths == nil {
+		// Install what was planned, even if the suggested version has since changed
+		if pkg.versionCode == 0 && version != nil && *version > 0 {
+			pkg.versionCode = *version
+		}
+
 		if err := pkg.UpdateCache(device); err != nil {
 			return nil, err
 		}
@@ -32,67 +100,228 @@ func (pkg FDroidPackage) GetApkPaths(device *adb.Device, _ *int) ([]string, erro
 	return pkg.Apk().Paths, nil
 }
 
-func (pkg FDroidPackage) UpdateCache(device *adb.Device) error {
-	apkDir, err := xdg.CacheFile("terraform-android/fdroid")
-	if err != nil {
-		return err
+// loadFDroidIndex prefers the index-v2 format, falling back to index-v1 for repos that don't publish it.
+// Offline, each is as last downloaded.
+func loadFDroidIndex(indexDir string, repo FDroidRepo, preparsed bool, offline bool) (*fdroid.Index, error) {
+	if repo.Fingerprint == "" {
+		return nil, fmt.Errorf("No signing key fingerprint configured for F-Droid repo %s", repo.URL)
 	}
 
-	err = os.MkdirAll(apkDir, 0775)
+	index, err := loadFDroidIndexV2(indexDir, repo, preparsed, offline)
+	if err == nil {
+		return index, nil
+	}
+	if !errors.Is(err, errNoIndexV2) {
+		return nil, err
+	}
+
+	log.Printf("[INFO] No index-v2 for %s, trying index-v1: %s", repo.URL, err)
+	return loadFDroidIndexV1(indexDir, repo, preparsed, offline)
+}
+
+func loadFDroidIndexV1(indexDir string, repo FDroidRepo, preparsed bool, offline bool) (*fdroid.Index, error) {
+	jarURL, err := repo.fileURL("index-v1.jar")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	apkPath := fmt.Sprintf("%s/%s.apk", apkDir, pkg.apk.Name)
-	pkg.apk.BasePath = &apkPath
-	pkg.apk.Paths = []string{apkPath}
-	jarpath := fmt.Sprintf("%s/fdroid-index.jar", apkDir)
+	jarpath := fmt.Sprintf("%s/index-%s.jar", indexDir, repo.cacheKey())
 
-	log.Println("Downloading F-Droid index")
-	if err = downloadEtag("https://f-droid.org/repo/index-v1.jar", jarpath, nil); err != nil && err != errNotModified {
-		return err
+	log.Println("Downloading F-Droid index", repo.URL)
+	if err = downloadEtag(jarURL, jarpath, nil, offline); err != nil && err != errNotModified {
+		return nil, err
 	}
 
 	jar, err := os.Open(jarpath)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer jar.Close()
 
 	stat, err := jar.Stat()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var source string
+	if preparsed {
+		h := sha256.New()
+		if _, err = io.Copy(h, jar); err != nil {
+			return nil, err
+		}
+		source = fmt.Sprintf("v1:%x", h.Sum(nil))
+
+		if index, ok := loadPreparsedIndex(indexDir, repo, source); ok {
+			return index, nil
+		}
+	}
+
+	zr, err := zip.NewReader(jar, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Verifying F-Droid index", repo.URL)
+	if err = verifyJarEntry(zr, "index-v1.json", repo.Fingerprint); err != nil {
+		return nil, fmt.Errorf("Untrusted F-Droid index from %s: %s", repo.URL, err)
 	}
 
-	log.Println("Loading F-Droid index")
+	log.Println("Loading F-Droid index", repo.URL)
 	index, err := fdroid.LoadIndexJar(jar, stat.Size(), nil)
+	if err == nil && preparsed {
+		savePreparsedIndex(indexDir, repo, source, index)
+	}
+	return index, err
+}
+
+func (pkg FDroidPackage) UpdateCache(device *adb.Device) error {
+	indexDir, err := xdg.CacheFile("terraform-android/fdroid")
 	if err != nil {
 		return err
 	}
 
-	var apk *fdroid.Apk
-	for _, app := range index.Apps {
-		log.Printf("[DEBUG] Found %s", app.PackageName)
-		if app.PackageName == pkg.apk.Name {
-			if apk = app.SuggestedApk(device); apk == nil {
-				return fmt.Errorf("No %s APK found for %s", pkg.apk.Name, device.Model)
+	err = os.MkdirAll(indexDir, 0775)
+	if err != nil {
+		return err
+	}
+
+	repos := pkg.repos
+	if len(repos) == 0 {
+		repos = []FDroidRepo{DefaultFDroidRepo}
+	}
+
+	// A repo that can't be searched (e.g. unreachable, or not signed by its fingerprint) is
+	// skipped, in case a later one has the app
+	var failures []string
+	for _, repo := range repos {
+		apk, err := pkg.findApk(indexDir, repo, device)
+		if err != nil {
+			log.Printf("[WARN] Failed to search %s for %s: %s", repo.URL, pkg.apk.Name, err)
+			failures = append(failures, fmt.Sprintf("%s: %s", repo.URL, err))
+			continue
+		}
+
+		if archive, ok := repo.archive(); ok && apk == nil && pkg.pinned() {
+			if apk, err = pkg.findApk(indexDir, archive, device); err != nil {
+				log.Printf("[WARN] Failed to search archive %s: %s", archive.URL, err)
+			} else if apk != nil {
+				repo = archive
 			}
-			break
 		}
+
+		if apk == nil {
+			continue
+		}
+
+		paths, err := pkg.fetchApk(repo, apk)
+		if err != nil {
+			return err
+		}
+
+		pkg.apk.BasePath = &paths[0]
+		pkg.apk.Paths = paths
+		return nil
 	}
 
-	if apk == nil {
-		return fmt.Errorf("[INFO] No such %s app found", pkg.apk.Name)
+	if len(failures) > 0 {
+		return fmt.Errorf("No %s app found in the F-Droid repos that could be searched, failed to search %s", pkg.apk.Name, strings.Join(failures, "; "))
+	}
+	if pkg.versionCode != 0 {
+		return fmt.Errorf("[INFO] No %s app found with versionCode %d", pkg.apk.Name, pkg.versionCode)
 	}
+	if pkg.apk.VersionFilter != nil {
+		return fmt.Errorf("[INFO] No %s app found satisfying %s", pkg.apk.Name, pkg.apk.VersionFilter)
+	}
+	return fmt.Errorf("[INFO] No such %s app found", pkg.apk.Name)
+}
 
-	if err := downloadEtag(apk.URL(), apkPath, apk.Hash); err != nil && err != errNotModified {
-		return fmt.Errorf("[INFO] Failed to download %s: %s", apk.ApkName, err)
+// fetchApk downloads the APK, unless it's already cached.
+func (pkg FDroidPackage) fetchApk(repo FDroidRepo, apk *fdroid.Apk) ([]string, error) {
+	source := fmt.Sprintf("fdroid:%x", apk.Hash)
+	if paths, ok, err := cachedBySource(source); err != nil || ok {
+		return paths, err
+	}
+
+	if pkg.apk.Offline {
+		return nil, errNotCached(fmt.Sprintf("%s %s (%d) from %s", apk.AppID, apk.VersName, apk.VersCode, repo.URL))
+	}
+
+	apkURL, err := repo.fileURL(apk.ApkName)
+	if err != nil {
+		return nil, err
+	}
+
+	stagingDir, err := cacheStagingDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	apkPath := filepath.Join(stagingDir, filepath.Base(apk.ApkName))
+	if err := downloadEtag(apkURL, apkPath, apk.Hash, pkg.apk.Offline); err != nil {
+		return nil, fmt.Errorf("[INFO] Failed to download %s: %s", apk.ApkName, err)
+	}
+
+	return cacheStore([]string{apkPath}, source, pkg.apk.evictionLimits())
+}
+
+func (pkg FDroidPackage) pinned() bool {
+	return pkg.versionCode != 0 || pkg.apk.VersionFilter != nil
+}
+
+// selectApk mirrors fdroid.App.SuggestedApk, but only considers versions allowed by the pin or filter.
+func (pkg FDroidPackage) selectApk(app fdroid.App, device *adb.Device) *fdroid.Apk {
+	allowed := func(apk *fdroid.Apk) bool {
+		if pkg.versionCode != 0 {
+			return apk.VersCode == pkg.versionCode
+		}
+		return pkg.apk.VersionFilter.Allows(apk.VersCode, apk.VersName)
+	}
+
+	for _, apk := range app.Apks {
+		if app.SugVersCode >= apk.VersCode && apk.IsCompatible(device) && allowed(apk) {
+			return apk
+		}
+	}
+
+	for _, apk := range app.Apks {
+		if apk.IsCompatible(device) && allowed(apk) {
+			return apk
+		}
 	}
 
 	return nil
 }
 
+// findApk returns the best allowed version of the app for device, or nil if repo doesn't have it.
+func (pkg FDroidPackage) findApk(indexDir string, repo FDroidRepo, device *adb.Device) (*fdroid.Apk, error) {
+	index, err := pkg.indices.load(indexDir, repo, pkg.apk.Offline)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, app := range index.Apps {
+		log.Printf("[DEBUG] Found %s", app.PackageName)
+		if app.PackageName != pkg.apk.Name {
+			continue
+		}
+
+		apk := pkg.selectApk(app, device)
+		if apk == nil && !pkg.pinned() {
+			return nil, fmt.Errorf("No %s APK found for %s in %s", pkg.apk.Name, device.Model, repo.URL)
+		}
+		if apk == nil {
+			log.Printf("[INFO] No allowed %s APK for %s in %s", pkg.apk.Name, device.Model, repo.URL)
+		}
+		return apk, nil
+	}
+
+	log.Printf("[INFO] No %s app found in %s", pkg.apk.Name, repo.URL)
+	return nil, nil
+}
+
 /* Borrowed from github.com/mvdan/fdroidcl/blob/4684bbe535147f80898e1e657bcd3cd253c11ec4/update.go
-*   without modification under BSD-3 (unimportable since it's in `package main`).
+*   under BSD-3, modified only to check the sha256 before replacing path, to replace it atomically under a lock, and not to print credentials (unimportable since it's in `package main`).
  */
 func respEtag(resp *http.Response) string {
 	etags, e := resp.Header["Etag"]
@@ -103,15 +332,40 @@ func respEtag(resp *http.Response) string {
 }
 
 var errNotModified = fmt.Errorf("not modified")
+
+// httpStatusError is a download that failed with the response's status.
+type httpStatusError int
+
+func (status httpStatusError) Error() string {
+	return fmt.Sprintf("download failed: %d %s", int(status), http.StatusText(int(status)))
+}
+
 var httpClient = &http.Client{}
 
-func downloadEtag(url, path string, sum []byte) error {
-	fmt.Printf("Downloading %s... ", url)
-	defer fmt.Println()
+// downloadEtag downloads url to path, unless it's not modified since last downloaded there.
+// Offline, what was last downloaded is used as if unmodified.
+func downloadEtag(url, path string, sum []byte, offline bool) error {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
+	fmt.Printf("Downloading %s... ", req.URL.Redacted())
+	defer fmt.Println()
+
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if offline {
+		// Use what was last downloaded, as if unchanged
+		if _, err := os.Stat(path); err == nil {
+			log.Printf("[INFO] Offline, using %s as last downloaded", req.URL.Redacted())
+			return errNotModified
+		}
+		return errNotCached(req.URL.Redacted())
+	}
 
 	etagPath := path + "-etag"
 	if _, err := os.Stat(path); err == nil {
@@ -125,37 +379,35 @@ func downloadEtag(url, path string, sum []byte) error {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("download failed: %d %s",
-			resp.StatusCode, http.StatusText(resp.StatusCode))
+		return httpStatusError(resp.StatusCode)
 	}
 	if resp.StatusCode == http.StatusNotModified {
 		fmt.Printf("not modified")
 		return errNotModified
 	}
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if sum == nil {
-		_, err := io.Copy(f, resp.Body)
-		if err != nil {
-			return err
-		}
-	} else {
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
+	var data []byte
+	if sum != nil {
+		// Check before opening path, so that a mismatch never replaces what's cached
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
 			return err
 		}
 		got := sha256.Sum256(data)
 		if !bytes.Equal(sum, got[:]) {
 			return fmt.Errorf("sha256 mismatch")
 		}
-		if _, err := f.Write(data); err != nil {
+	}
+	err = writeFileAtomic(path, func(f io.Writer) error {
+		if sum == nil {
+			_, err := io.Copy(f, resp.Body)
 			return err
 		}
+		_, err := f.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
 	}
-	if err := ioutil.WriteFile(etagPath, []byte(respEtag(resp)), 0o644); err != nil {
+	if err := writeFileDataAtomic(etagPath, []byte(respEtag(resp))); err != nil {
 		return err
 	}
 	fmt.Printf("done")
@@ -0,0 +1,325 @@
+package repo
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/fdroidcl/fdroid"
+)
+
+// fdroidEntry is the signed `entry.json` of an index-v2 repo, pointing to the index and diffs against it.
+type fdroidEntry struct {
+	Timestamp int64                 `json:"timestamp"`
+	Version   int                   `json:"version"`
+	Index     fdroidFile            `json:"index"`
+	Diffs     map[string]fdroidFile `json:"diffs"`
+}
+
+type fdroidFile struct {
+	Name   string `json:"name"`
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+type fdroidIndexV2 struct {
+	Repo struct {
+		Address   string `json:"address"`
+		Timestamp int64  `json:"timestamp"`
+	} `json:"repo"`
+	Packages map[string]struct {
+		Versions map[string]fdroidVersionV2 `json:"versions"`
+	} `json:"packages"`
+}
+
+type fdroidVersionV2 struct {
+	Added    int64      `json:"added"`
+	File     fdroidFile `json:"file"`
+	Manifest struct {
+		VersionName string `json:"versionName"`
+		VersionCode int    `json:"versionCode"`
+		UsesSdk     struct {
+			MinSdkVersion int `json:"minSdkVersion"`
+		} `json:"usesSdk"`
+		MaxSdkVersion  int      `json:"maxSdkVersion"`
+		NativeCode     []string `json:"nativecode"`
+		UsesPermission []struct {
+			Name string `json:"name"`
+		} `json:"usesPermission"`
+	} `json:"manifest"`
+	ReleaseChannels []string `json:"releaseChannels"`
+}
+
+var errNoIndexV2 = fmt.Errorf("no index-v2")
+
+func loadFDroidEntry(indexDir string, repo FDroidRepo, offline bool) (*fdroidEntry, error) {
+	jarURL, err := repo.fileURL("entry.jar")
+	if err != nil {
+		return nil, err
+	}
+
+	jarpath := fmt.Sprintf("%s/entry-%s.jar", indexDir, repo.cacheKey())
+
+	log.Println("Downloading F-Droid entry", repo.URL)
+	err = downloadEtag(jarURL, jarpath, nil, offline)
+	switch {
+	case err == nil, err == errNotModified:
+	case err == httpStatusError(http.StatusNotFound), offline:
+		// Not published, or not cached to use offline, in which case index-v1 may be
+		return nil, fmt.Errorf("%w: %s", errNoIndexV2, err)
+	default:
+		return nil, err
+	}
+
+	zr, err := zip.OpenReader(jarpath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	log.Println("Verifying F-Droid entry", repo.URL)
+	if err = verifyJarEntry(&zr.Reader, "entry.json", repo.Fingerprint); err != nil {
+		return nil, fmt.Errorf("Untrusted F-Droid entry from %s: %s", repo.URL, err)
+	}
+
+	data, err := readZipEntry(&zr.Reader, "entry.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var entry fdroidEntry
+	if err = json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// fetchFDroidFile downloads a file listed in the entry, verifying it against the signed sha256.
+func fetchFDroidFile(repo FDroidRepo, file fdroidFile, offline bool) ([]byte, error) {
+	if offline {
+		return nil, errNotCached(fmt.Sprintf("%s from %s", file.Name, repo.URL))
+	}
+
+	fileURL, err := repo.fileURL(strings.TrimPrefix(file.Name, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	sum, err := hex.DecodeString(file.Sha256)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Get(fileURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("download failed: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if got := sha256.Sum256(data); !bytes.Equal(sum, got[:]) {
+		return nil, fmt.Errorf("sha256 mismatch for %s", file.Name)
+	}
+
+	return data, nil
+}
+
+// mergePatch applies an RFC 7386 JSON Merge Patch, which is the format of index-v2 diffs.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = mergePatch(targetObj[k], v)
+		}
+	}
+
+	return targetObj
+}
+
+func decodeJSONNumbers(data []byte) (interface{}, error) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&v)
+	return v, err
+}
+
+// updateFDroidIndexV2 brings the cached index at path up to date with entry, by a diff if one
+// is available from the cached version, or else by downloading the whole index. An entry older
+// than the cached index is refused, lest a replayed one roll the repo back to vulnerable versions.
+func updateFDroidIndexV2(path string, repo FDroidRepo, entry *fdroidEntry, offline bool) ([]byte, error) {
+	cached, err := ioutil.ReadFile(path)
+	if err == nil {
+		var index fdroidIndexV2
+		if err = json.Unmarshal(cached, &index); err == nil {
+			if entry.Timestamp < index.Repo.Timestamp {
+				return nil, fmt.Errorf("F-Droid entry from %s is at %d, older than the index already loaded at %d: refusing to roll back", repo.URL, entry.Timestamp, index.Repo.Timestamp)
+			}
+
+			if index.Repo.Timestamp == entry.Timestamp {
+				log.Println("F-Droid index up to date", repo.URL)
+				return cached, nil
+			}
+
+			if diff, ok := entry.Diffs[strconv.FormatInt(index.Repo.Timestamp, 10)]; ok {
+				log.Printf("Applying F-Droid index diff %s from %s", diff.Name, repo.URL)
+				patched, err := applyFDroidDiff(cached, repo, diff, offline)
+				if err == nil {
+					return patched, nil
+				}
+				log.Printf("[WARN] Failed to apply F-Droid index diff from %s: %s", repo.URL, err)
+			}
+		}
+	}
+
+	log.Println("Downloading F-Droid index", repo.URL)
+	return fetchFDroidFile(repo, entry.Index, offline)
+}
+
+func applyFDroidDiff(cached []byte, repo FDroidRepo, diff fdroidFile, offline bool) ([]byte, error) {
+	patchData, err := fetchFDroidFile(repo, diff, offline)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := decodeJSONNumbers(cached)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := decodeJSONNumbers(patchData)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergePatch(target, patch))
+}
+
+// toFDroidIndex converts to the v1 representation used by fdroidcl, for its compatibility checks.
+func (v2 *fdroidIndexV2) toFDroidIndex() (*fdroid.Index, error) {
+	index := &fdroid.Index{
+		Packages: make(map[string][]fdroid.Apk),
+	}
+	index.Repo.Address = v2.Repo.Address
+
+	for name, pkg := range v2.Packages {
+		app := fdroid.App{PackageName: name}
+		var apks []fdroid.Apk
+
+		for _, version := range pkg.Versions {
+			hash, err := hex.DecodeString(version.File.Sha256)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid sha256 for %s: %s", version.File.Name, err)
+			}
+
+			apk := fdroid.Apk{
+				VersName: version.Manifest.VersionName,
+				VersCode: version.Manifest.VersionCode,
+				Size:     version.File.Size,
+				MinSdk:   version.Manifest.UsesSdk.MinSdkVersion,
+				MaxSdk:   version.Manifest.MaxSdkVersion,
+				ABIs:     version.Manifest.NativeCode,
+				ApkName:  strings.TrimPrefix(version.File.Name, "/"),
+				Hash:     hash,
+				HashType: "sha256",
+				AppID:    name,
+				RepoURL:  v2.Repo.Address,
+			}
+			for _, perm := range version.Manifest.UsesPermission {
+				apk.Perms = append(apk.Perms, perm.Name)
+			}
+			apks = append(apks, apk)
+
+			// Only versions not in a beta (etc.) release channel are suggested
+			if len(version.ReleaseChannels) == 0 && apk.VersCode > app.SugVersCode {
+				app.SugVersCode = apk.VersCode
+				app.SugVersName = apk.VersName
+			}
+		}
+
+		sort.Sort(fdroid.ApkList(apks))
+		index.Packages[name] = apks
+		for i := range apks {
+			app.Apks = append(app.Apks, &index.Packages[name][i])
+		}
+		index.Apps = append(index.Apps, app)
+	}
+
+	sort.Sort(fdroid.AppList(index.Apps))
+	return index, nil
+}
+
+func loadFDroidIndexV2(indexDir string, repo FDroidRepo, preparsed bool, offline bool) (*fdroid.Index, error) {
+	entry, err := loadFDroidEntry(indexDir, repo, offline)
+	if err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf("%s/index-v2-%s.json", indexDir, repo.cacheKey())
+	unlock, err := lockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	source := fmt.Sprintf("v2:%d", entry.Timestamp)
+	if preparsed {
+		if index, ok := loadPreparsedIndex(indexDir, repo, source); ok {
+			return index, nil
+		}
+	}
+
+	data, err := updateFDroidIndexV2(path, repo, entry, offline)
+	if err != nil {
+		return nil, err
+	}
+
+	var v2 fdroidIndexV2
+	if err = json.Unmarshal(data, &v2); err != nil {
+		return nil, err
+	}
+
+	if v2.Repo.Timestamp != entry.Timestamp {
+		return nil, fmt.Errorf("F-Droid index from %s is at %d, but entry expected %d", repo.URL, v2.Repo.Timestamp, entry.Timestamp)
+	}
+
+	if err = writeFileDataAtomic(path, data); err != nil {
+		return nil, err
+	}
+
+	log.Println("Loading F-Droid index", repo.URL)
+	index, err := v2.toFDroidIndex()
+	if err == nil && preparsed {
+		savePreparsedIndex(indexDir, repo, source, index)
+	}
+	return index, err
+}
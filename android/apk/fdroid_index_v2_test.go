@@ -0,0 +1,221 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"mvdan.cc/fdroidcl/fdroid"
+)
+
+func testFDroidFile(name string, data []byte) fdroidFile {
+	sum := sha256.Sum256(data)
+	return fdroidFile{Name: name, Sha256: fmt.Sprintf("%x", sum), Size: int64(len(data))}
+}
+
+// testFDroidVersionV2 is the index-v2 version of org.example.app @ versionCode.
+func testFDroidVersionV2(versionCode int) (string, map[string]interface{}) {
+	apk := testFDroidFile(fmt.Sprintf("/org.example.app_%d.apk", versionCode), []byte(fmt.Sprint(versionCode)))
+	return apk.Sha256, map[string]interface{}{
+		"added":    1700000000000,
+		"file":     apk,
+		"manifest": map[string]interface{}{"versionCode": versionCode, "versionName": fmt.Sprintf("%d.0", versionCode)},
+	}
+}
+
+// testFDroidIndexV2 is an index-v2.json at timestamp, of org.example.app at versionCodes.
+func testFDroidIndexV2(t *testing.T, timestamp int64, versionCodes ...int) []byte {
+	versions := make(map[string]interface{})
+	for _, versionCode := range versionCodes {
+		sum, version := testFDroidVersionV2(versionCode)
+		versions[sum] = version
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"repo":     map[string]interface{}{"address": "https://example.org/repo", "timestamp": timestamp},
+		"packages": map[string]interface{}{"org.example.app": map[string]interface{}{"versions": versions}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// publishFDroidIndexV2 serves the index, with an entry.jar signed by key, and diffs from others
+// previously published.
+func (repo *fdroidTestRepo) publishFDroidIndexV2(t *testing.T, key *SigningKey, timestamp int64, index []byte, diffs map[int64][]byte) {
+	entry := fdroidEntry{
+		Timestamp: timestamp,
+		Version:   20002,
+		Index:     testFDroidFile("/index-v2.json", index),
+		Diffs:     make(map[string]fdroidFile),
+	}
+	repo.files["index-v2.json"] = index
+
+	for from, diff := range diffs {
+		name := fmt.Sprintf("diff/%d.json", from)
+		entry.Diffs[fmt.Sprint(from)] = testFDroidFile("/"+name, diff)
+		repo.files[name] = diff
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.files["entry.jar"] = testSignedJar(t, key, map[string][]byte{"entry.json": data})
+}
+
+func fdroidIndexVersions(index *fdroid.Index) []string {
+	var versions []string
+	for _, apk := range index.Packages["org.example.app"] {
+		versions = append(versions, fmt.Sprintf("%s (%d)", apk.VersName, apk.VersCode))
+	}
+	return versions
+}
+
+func TestLoadFDroidIndexV2(t *testing.T) {
+	key := testSigningKey(t)
+	fingerprint := certFingerprint(key.Cert)
+
+	for _, tc := range []struct {
+		name     string
+		setup    func(repo *fdroidTestRepo)
+		versions []string
+		// Requested of the repo, in order
+		requests []string
+		err      string
+	}{
+		{
+			name:     "index-v2",
+			setup:    func(repo *fdroidTestRepo) {},
+			versions: []string{"42.0 (42)"},
+			requests: []string{"entry.jar", "index-v2.json"},
+		},
+		{
+			name:     "entry not found",
+			setup:    func(repo *fdroidTestRepo) { delete(repo.files, "entry.jar") },
+			versions: []string{"4.2 (42)"},
+			requests: []string{"entry.jar", "index-v1.jar"},
+		},
+		{
+			name:     "entry failed",
+			setup:    func(repo *fdroidTestRepo) { repo.errors["entry.jar"] = http.StatusInternalServerError },
+			requests: []string{"entry.jar"},
+			err:      "download failed: 500 Internal Server Error",
+		},
+		{
+			name: "entry signed by another key",
+			setup: func(repo *fdroidTestRepo) {
+				repo.publishFDroidIndexV2(t, testSigningKey(t), 1000, repo.files["index-v2.json"], nil)
+			},
+			requests: []string{"entry.jar"},
+			err:      "Untrusted F-Droid entry from ",
+		},
+		{
+			name:     "index sha256 mismatch",
+			setup:    func(repo *fdroidTestRepo) { repo.files["index-v2.json"] = testFDroidIndexV2(t, 1000, 42, 43) },
+			requests: []string{"entry.jar", "index-v2.json"},
+			err:      "sha256 mismatch for /index-v2.json",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			repo := newFDroidTestRepo(t, make(map[string][]byte))
+			repo.files["index-v1.jar"] = testFDroidIndexV1(t, key, repo.url(), []byte("42"))
+			repo.publishFDroidIndexV2(t, key, 1000, testFDroidIndexV2(t, 1000, 42), nil)
+			tc.setup(repo)
+
+			index, err := loadFDroidIndex(t.TempDir(), FDroidRepo{URL: repo.url(), Fingerprint: fingerprint}, false, false)
+
+			if !equalStrings(repo.requests, tc.requests) {
+				t.Errorf("Requested %v, want %v", repo.requests, tc.requests)
+			}
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Got error %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fdroidIndexVersions(index); !equalStrings(got, tc.versions) {
+				t.Errorf("Got versions %v, want %v", got, tc.versions)
+			}
+		})
+	}
+}
+
+func TestUpdateFDroidIndexV2(t *testing.T) {
+	key := testSigningKey(t)
+	indexDir := t.TempDir()
+	repo := newFDroidTestRepo(t, make(map[string][]byte))
+	fdroidRepo := FDroidRepo{URL: repo.url(), Fingerprint: certFingerprint(key.Cert)}
+
+	sum43, version43 := testFDroidVersionV2(43)
+	diff, err := json.Marshal(map[string]interface{}{
+		"repo":     map[string]interface{}{"timestamp": 2000},
+		"packages": map[string]interface{}{"org.example.app": map[string]interface{}{"versions": map[string]interface{}{sum43: version43}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		name     string
+		publish  func()
+		versions []string
+		requests []string
+		err      string
+	}{
+		{
+			name:     "initial",
+			publish:  func() { repo.publishFDroidIndexV2(t, key, 1000, testFDroidIndexV2(t, 1000, 42), nil) },
+			versions: []string{"42.0 (42)"},
+			requests: []string{"entry.jar", "index-v2.json"},
+		},
+		{
+			name:     "unchanged",
+			publish:  func() {},
+			versions: []string{"42.0 (42)"},
+			requests: []string{"entry.jar"},
+		},
+		{
+			name: "diff",
+			publish: func() {
+				repo.publishFDroidIndexV2(t, key, 2000, testFDroidIndexV2(t, 2000, 42, 43), map[int64][]byte{1000: diff})
+			},
+			versions: []string{"43.0 (43)", "42.0 (42)"},
+			requests: []string{"entry.jar", "diff/1000.json"},
+		},
+		{
+			name:     "rolled back",
+			publish:  func() { repo.publishFDroidIndexV2(t, key, 1000, testFDroidIndexV2(t, 1000, 42), nil) },
+			requests: []string{"entry.jar"},
+			err:      fmt.Sprintf("F-Droid entry from %s is at 1000, older than the index already loaded at 2000: refusing to roll back", repo.url()),
+		},
+	} {
+		repo.requests = nil
+		step.publish()
+
+		index, err := loadFDroidIndex(indexDir, fdroidRepo, false, false)
+
+		if !equalStrings(repo.requests, step.requests) {
+			t.Errorf("%s: requested %v, want %v", step.name, repo.requests, step.requests)
+		}
+		if step.err != "" {
+			if err == nil || err.Error() != step.err {
+				t.Fatalf("%s: got error %v, want %s", step.name, err, step.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		if got := fdroidIndexVersions(index); !equalStrings(got, step.versions) {
+			t.Errorf("%s: got versions %v, want %v", step.name, got, step.versions)
+		}
+	}
+}
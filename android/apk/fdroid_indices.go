@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"encoding/gob"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"mvdan.cc/fdroidcl/fdroid"
+)
+
+// FDroidIndices holds the F-Droid indices loaded by a provider run, so that each repo's is
+// downloaded and parsed once, however many packages are acquired from it concurrently. Failures
+// aren't kept, so the next package to need the repo tries again.
+type FDroidIndices struct {
+	preparsed bool
+	mu        sync.Mutex
+	loads     map[string]*fdroidIndexLoad
+}
+
+type fdroidIndexLoad struct {
+	once  sync.Once
+	index *fdroid.Index
+	err   error
+}
+
+// NewFDroidIndices returns an empty FDroidIndices. If preparsed, indices are also stored on disk
+// in a form that's quicker to load, for the next run to use if the repo hasn't changed.
+func NewFDroidIndices(preparsed bool) *FDroidIndices {
+	return &FDroidIndices{
+		preparsed: preparsed,
+		loads:     make(map[string]*fdroidIndexLoad),
+	}
+}
+
+func (indices *FDroidIndices) load(indexDir string, repo FDroidRepo, offline bool) (*fdroid.Index, error) {
+	if indices == nil {
+		return loadFDroidIndex(indexDir, repo, false, offline)
+	}
+
+	key := repo.URL + "\n" + repo.Fingerprint
+	indices.mu.Lock()
+	load, ok := indices.loads[key]
+	if !ok {
+		load = &fdroidIndexLoad{}
+		indices.loads[key] = load
+	}
+	indices.mu.Unlock()
+
+	load.once.Do(func() {
+		load.index, load.err = loadFDroidIndex(indexDir, repo, indices.preparsed, offline)
+	})
+
+	if load.err != nil {
+		// Only those already waiting on it share a failure; later packages retry, in case it
+		// was transient
+		indices.mu.Lock()
+		if indices.loads[key] == load {
+			delete(indices.loads, key)
+		}
+		indices.mu.Unlock()
+	}
+
+	return load.index, load.err
+}
+
+// preparsedIndex is an index as stored on disk, with the source it was parsed from, identified
+// by the index-v2 timestamp or index-v1 jar's hash.
+type preparsedIndex struct {
+	Source string
+	Index  fdroid.Index
+}
+
+func preparsedIndexPath(indexDir string, repo FDroidRepo) string {
+	return indexDir + "/index-" + repo.cacheKey() + ".gob"
+}
+
+// loadPreparsedIndex returns the pre-parsed index, if it's of source.
+func loadPreparsedIndex(indexDir string, repo FDroidRepo, source string) (*fdroid.Index, bool) {
+	f, err := os.Open(preparsedIndexPath(indexDir, repo))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	var preparsed preparsedIndex
+	if err = gob.NewDecoder(f).Decode(&preparsed); err != nil {
+		log.Printf("[WARN] Ignoring corrupt pre-parsed F-Droid index of %s: %s", repo.URL, err)
+		return nil, false
+	}
+
+	if preparsed.Source != source {
+		return nil, false
+	}
+
+	// Not stored, since they'd be duplicates of Packages
+	index := &preparsed.Index
+	for i := range index.Apps {
+		app := &index.Apps[i]
+		for j := range index.Packages[app.PackageName] {
+			app.Apks = append(app.Apks, &index.Packages[app.PackageName][j])
+		}
+	}
+
+	log.Println("Loaded pre-parsed F-Droid index", repo.URL)
+	return index, true
+}
+
+func savePreparsedIndex(indexDir string, repo FDroidRepo, source string, index *fdroid.Index) {
+	preparsed := preparsedIndex{Source: source, Index: *index}
+	preparsed.Index.Apps = make([]fdroid.App, len(index.Apps))
+	for i, app := range index.Apps {
+		app.Apks = nil
+		preparsed.Index.Apps[i] = app
+	}
+
+	err := writeFileAtomic(preparsedIndexPath(indexDir, repo), func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(&preparsed)
+	})
+	if err != nil {
+		log.Printf("[WARN] Failed to store pre-parsed F-Droid index of %s: %s", repo.URL, err)
+	}
+}
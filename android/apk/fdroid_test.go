@@ -0,0 +1,210 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mvdan.cc/fdroidcl/adb"
+)
+
+// testSignedJar is a JAR of files signed by key, as F-Droid signs its index files.
+func testSignedJar(t *testing.T, key *SigningKey, files map[string][]byte) []byte {
+	w := newApkWriter()
+	for name, data := range files {
+		if err := w.add(name, data, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.writeEntries(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.signV1(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w.buf.Bytes()
+}
+
+// fdroidTestRepo is an F-Droid repo served at /repo, whose files may be changed between requests.
+type fdroidTestRepo struct {
+	*httptest.Server
+	// By name; others aren't found
+	files map[string][]byte
+	// Statuses to fail with instead of serving files, by name
+	errors map[string]int
+	// Names requested, in order
+	requests []string
+}
+
+func newFDroidTestRepo(t *testing.T, files map[string][]byte) *fdroidTestRepo {
+	repo := &fdroidTestRepo{files: files, errors: make(map[string]int)}
+	repo.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/repo/")
+		repo.requests = append(repo.requests, name)
+
+		if status, ok := repo.errors[name]; ok {
+			w.WriteHeader(status)
+			return
+		}
+		data, ok := repo.files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(repo.Close)
+	return repo
+}
+
+func (repo *fdroidTestRepo) url() string {
+	return repo.URL + "/repo"
+}
+
+// testFDroidIndexV1 is an index-v1.jar, signed by key, of org.example.app @ 42 as apk.
+func testFDroidIndexV1(t *testing.T, key *SigningKey, address string, apk []byte) []byte {
+	sum := sha256.Sum256(apk)
+	index, err := json.Marshal(map[string]interface{}{
+		"repo": map[string]interface{}{"address": address, "timestamp": 1700000000000, "version": 21},
+		"apps": []interface{}{
+			map[string]interface{}{"packageName": "org.example.app", "suggestedVersionCode": "42"},
+		},
+		"packages": map[string]interface{}{
+			"org.example.app": []interface{}{map[string]interface{}{
+				"versionCode": 42,
+				"versionName": "4.2",
+				"apkname":     "org.example.app_42.apk",
+				"hash":        fmt.Sprintf("%x", sum),
+				"hashType":    "sha256",
+				"size":        len(apk),
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSignedJar(t, key, map[string][]byte{"index-v1.json": index})
+}
+
+var testFDroidDevice = &adb.Device{ID: "test", Model: "test", ABIs: []string{"arm64-v8a"}, APILevel: 30}
+
+func TestFDroidRepos(t *testing.T) {
+	key, otherKey := testSigningKey(t), testSigningKey(t)
+	apk := testSplitApks(t, key)["base"]
+
+	trusted := newFDroidTestRepo(t, nil)
+	trusted.files = map[string][]byte{
+		"index-v1.jar":           testFDroidIndexV1(t, key, trusted.url(), apk),
+		"org.example.app_42.apk": apk,
+	}
+
+	// Serves the same index, but re-signed by another key
+	impostor := newFDroidTestRepo(t, nil)
+	impostor.files = map[string][]byte{
+		"index-v1.jar":           testFDroidIndexV1(t, otherKey, impostor.url(), apk),
+		"org.example.app_42.apk": apk,
+	}
+
+	fingerprint := certFingerprint(key.Cert)
+	var colonFingerprint []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		colonFingerprint = append(colonFingerprint, strings.ToUpper(fingerprint[i:i+2]))
+	}
+
+	for _, tc := range []struct {
+		name  string
+		repos []FDroidRepo
+		from  *fdroidTestRepo
+		err   string
+	}{
+		{name: "trusted", repos: []FDroidRepo{{URL: trusted.url(), Fingerprint: fingerprint}}, from: trusted},
+		{name: "colon-separated fingerprint", repos: []FDroidRepo{{URL: trusted.url(), Fingerprint: strings.Join(colonFingerprint, ":")}}, from: trusted},
+		{
+			name:  "wrong fingerprint",
+			repos: []FDroidRepo{{URL: impostor.url(), Fingerprint: fingerprint}},
+			err:   fmt.Sprintf("Untrusted F-Droid index from %s: signed by %s, expected %s", impostor.url(), certFingerprint(otherKey.Cert), fingerprint),
+		},
+		{
+			name:  "wrong fingerprint, then trusted",
+			repos: []FDroidRepo{{URL: impostor.url(), Fingerprint: fingerprint}, {URL: trusted.url(), Fingerprint: fingerprint}},
+			from:  trusted,
+		},
+		{name: "no fingerprint", repos: []FDroidRepo{{URL: trusted.url()}}, err: "No signing key fingerprint configured for F-Droid repo " + trusted.url()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestCache(t)
+			trusted.requests, impostor.requests = nil, nil
+
+			pkg, err := Package([]string{"fdroid"}, "org.example.app", Options{FDroidRepos: tc.repos})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = pkg.UpdateCache(testFDroidDevice)
+
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Got error %v, want %s", err, tc.err)
+				}
+				if len(impostor.requests) > 0 && impostor.requests[len(impostor.requests)-1] != "index-v1.jar" {
+					t.Errorf("Requested %v of the untrusted repo, beyond its index", impostor.requests)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if version, err := Version(pkg); err != nil || version != 42 {
+				t.Errorf("Got versionCode %d (%v), want 42", version, err)
+			}
+			if got := tc.from.requests[len(tc.from.requests)-1]; got != "org.example.app_42.apk" {
+				t.Errorf("Last requested %s of the repo, want the APK", got)
+			}
+		})
+	}
+}
+
+func TestFDroidRepoAuth(t *testing.T) {
+	useTestCache(t)
+	key := testSigningKey(t)
+	apk := testSplitApks(t, key)["base"]
+
+	repo := newFDroidTestRepo(t, nil)
+	repo.files = map[string][]byte{
+		"index-v1.jar":           testFDroidIndexV1(t, key, repo.url(), apk),
+		"org.example.app_42.apk": apk,
+	}
+
+	handler := repo.Config.Handler
+	repo.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	fdroidRepo := FDroidRepo{URL: repo.url(), Fingerprint: certFingerprint(key.Cert), Username: "user", Password: "secret"}
+	pkg, err := Package([]string{"fdroid"}, "org.example.app", Options{FDroidRepos: []FDroidRepo{fdroidRepo}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pkg.UpdateCache(testFDroidDevice); err != nil {
+		t.Fatal(err)
+	}
+
+	fdroidRepo.Password = "wrong"
+	if pkg, err = Package([]string{"fdroid"}, "org.example.app", Options{FDroidRepos: []FDroidRepo{fdroidRepo}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = pkg.UpdateCache(testFDroidDevice); err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Errorf("Got error %v with the wrong password, want 401 Unauthorized", err)
+	}
+}
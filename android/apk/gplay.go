@@ -0,0 +1,381 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"mvdan.cc/fdroidcl/adb"
+)
+
+// A client of the Google Play API (as used by the Play Store app, and gplaycli before it) for
+// the details of an app's current version and where to download its APKs.
+//
+// Field numbers are those of googleplay.proto, as reverse-engineered by the community.
+
+// Overridden to test against a stub server
+var gplayBaseURL = "https://android.clients.google.com/fdfe/"
+
+// GPlayConfig is what's needed to use the API as a device that's checked in to Google Play.
+type GPlayConfig struct {
+	// Auth token of the Google account
+	Token string
+	// Google Services Framework ID, in hex, of the device the account's checked in with
+	GSFID string
+	// Properties of the device to request APKs for, as in gplaycli's and AuroraStore's device
+	// profiles, or if nil those of the device being installed to
+	DeviceProfile GPlayDeviceProfile
+}
+
+// GPlayDeviceProfile is a device's properties, e.g. `Build.MODEL`, `Platforms`.
+type GPlayDeviceProfile map[string]string
+
+// Used if the device profile doesn't say, from a current Play Store app
+var gplayDefaultProfile = GPlayDeviceProfile{
+	"Vending.version":       "82201710",
+	"Vending.versionString": "22.0.17-21 [0] [PR] 332555730",
+	"Locales":               "en-US",
+}
+
+// LoadGPlayDeviceProfile reads a device profile in the `.properties` format of gplaycli and AuroraStore.
+func LoadGPlayDeviceProfile(path string) (GPlayDeviceProfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	profile := make(GPlayDeviceProfile)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid line in device profile %s: %s", path, line)
+		}
+		profile[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return profile, scanner.Err()
+}
+
+// gplayDeviceProfileFromProps makes a device profile from `getprop`.
+func gplayDeviceProfileFromProps(props map[string]string) GPlayDeviceProfile {
+	spec := DeviceSpecFromProps(props)
+
+	profile := GPlayDeviceProfile{
+		"Build.DEVICE":          props["ro.product.device"],
+		"Build.HARDWARE":        props["ro.hardware"],
+		"Build.ID":              props["ro.build.id"],
+		"Build.MODEL":           props["ro.product.model"],
+		"Build.PRODUCT":         props["ro.product.name"],
+		"Build.VERSION.RELEASE": props["ro.build.version.release"],
+		"Build.VERSION.SDK_INT": props["ro.build.version.sdk"],
+		"Platforms":             strings.Join(spec.ABIs, ","),
+		"Screen.Density":        props["ro.sf.lcd_density"],
+	}
+	if len(spec.Locales) > 0 {
+		profile["Locales"] = strings.Join(spec.Locales, ",")
+	}
+
+	return profile
+}
+
+func (profile GPlayDeviceProfile) get(key string) string {
+	if v, ok := profile[key]; ok && v != "" {
+		return v
+	}
+	return gplayDefaultProfile[key]
+}
+
+func (profile GPlayDeviceProfile) userAgent() string {
+	return fmt.Sprintf(
+		"Android-Finsky/%s (api=3,versionCode=%s,sdk=%s,device=%s,hardware=%s,product=%s,platformVersionRelease=%s,model=%s,buildId=%s,isWideScreen=0,supportedAbis=%s)",
+		profile.get("Vending.versionString"),
+		profile.get("Vending.version"),
+		profile.get("Build.VERSION.SDK_INT"),
+		profile.get("Build.DEVICE"),
+		profile.get("Build.HARDWARE"),
+		profile.get("Build.PRODUCT"),
+		profile.get("Build.VERSION.RELEASE"),
+		strings.ReplaceAll(profile.get("Build.MODEL"), " ", "_"),
+		profile.get("Build.ID"),
+		strings.ReplaceAll(profile.get("Platforms"), ",", ";"),
+	)
+}
+
+// key identifies what the profile would be served, for the cache.
+func (profile GPlayDeviceProfile) key() string {
+	var keys []string
+	for k := range profile {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, profile[k])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:16]
+}
+
+type gplayClient struct {
+	config  *GPlayConfig
+	profile GPlayDeviceProfile
+}
+
+func newGPlayClient(config *GPlayConfig, device *adb.Device) (*gplayClient, error) {
+	if config == nil || config.Token == "" || config.GSFID == "" {
+		return nil, fmt.Errorf("The provider's gplay_token and gplay_gsf_id are required to download from Google Play")
+	}
+
+	profile := config.DeviceProfile
+	if profile == nil {
+		if device == nil {
+			return nil, fmt.Errorf("A device or the provider's gplay_device_profile is required to download from Google Play")
+		}
+
+		props, err := device.AdbProps()
+		if err != nil {
+			return nil, err
+		}
+		profile = gplayDeviceProfileFromProps(props)
+	}
+
+	return &gplayClient{config, profile}, nil
+}
+
+// call makes a request of the API, returning the response's payload.
+func (c *gplayClient) call(method string, path string, params url.Values) (pbMessage, error) {
+	var req *http.Request
+	var err error
+	if method == "POST" {
+		req, err = http.NewRequest(method, gplayBaseURL+path, strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
+		}
+	} else {
+		req, err = http.NewRequest(method, gplayBaseURL+path+"?"+params.Encode(), nil)
+	}
+	if err != nil {
+		return pbMessage{}, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	req.Header.Set("User-Agent", c.profile.userAgent())
+	req.Header.Set("X-DFE-Device-Id", c.config.GSFID)
+	req.Header.Set("X-DFE-Client-Id", "am-android-google")
+	req.Header.Set("Accept-Language", strings.Split(c.profile.get("Locales"), ",")[0])
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return pbMessage{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return pbMessage{}, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return pbMessage{}, fmt.Errorf("Google Play rejected gplay_token, which may have expired")
+	}
+
+	// ResponseWrapper
+	wrapper, err := parsePB(body)
+	if err != nil && resp.StatusCode < 400 {
+		return pbMessage{}, err
+	}
+
+	// commands.displayErrorMessage
+	if commands, ok := wrapper.message(2); ok && commands.str(2) != "" {
+		return pbMessage{}, fmt.Errorf("Google Play: %s", commands.str(2))
+	}
+
+	if resp.StatusCode >= 400 {
+		return pbMessage{}, fmt.Errorf("Google Play %s failed: %d %s", path, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	payload, _ := wrapper.message(1)
+	return payload, nil
+}
+
+type gplayDetails struct {
+	versionCode   int
+	versionString string
+	offerType     int
+}
+
+func (c *gplayClient) details(pkg string) (*gplayDetails, error) {
+	payload, err := c.call("GET", "details", url.Values{"doc": {pkg}})
+	if err != nil {
+		return nil, err
+	}
+
+	// detailsResponse.docV2
+	doc, ok := payload.message(2, 4)
+	if !ok {
+		return nil, fmt.Errorf("%s not found on Google Play", pkg)
+	}
+
+	// details.appDetails
+	app, ok := doc.message(13, 1)
+	if !ok || app.uint(3) == 0 {
+		return nil, fmt.Errorf("No app details for %s on Google Play", pkg)
+	}
+
+	details := &gplayDetails{
+		versionCode:   int(app.uint(3)),
+		versionString: app.str(4),
+		offerType:     1,
+	}
+	if offer, ok := doc.message(8); ok && offer.uint(8) != 0 {
+		details.offerType = int(offer.uint(8))
+	}
+
+	return details, nil
+}
+
+type gplayFile struct {
+	name string
+	url  string
+	size int64
+	// Base64 (URL-safe) SHA-1 of the file, or empty
+	sha1 string
+}
+
+type gplayDelivery struct {
+	// Base APK first, then splits
+	apks   []gplayFile
+	obbs   []gplayFile
+	cookie *http.Cookie
+}
+
+// delivery acquires an app (which does nothing if it's free and already acquired) and returns
+// where to download it.
+func (c *gplayClient) delivery(pkg string, versionCode int, offerType int) (*gplayDelivery, error) {
+	params := url.Values{
+		"doc": {pkg},
+		"ot":  {fmt.Sprint(offerType)},
+		"vc":  {fmt.Sprint(versionCode)},
+	}
+
+	// buyResponse.downloadToken
+	if payload, err := c.call("POST", "purchase", params); err != nil {
+		log.Printf("[WARN] Failed to acquire %s on Google Play, trying to download anyway: %s", pkg, err)
+	} else if buy, ok := payload.message(4); ok && buy.str(55) != "" {
+		params.Set("dtok", buy.str(55))
+	}
+
+	payload, err := c.call("GET", "delivery", params)
+	if err != nil {
+		return nil, err
+	}
+
+	// deliveryResponse
+	resp, ok := payload.message(21)
+	if status := resp.uint(1); ok && status > 1 {
+		return nil, fmt.Errorf("Google Play can't deliver %s @ %d (status %d): is it compatible with the device profile?", pkg, versionCode, status)
+	}
+
+	// appDeliveryData
+	data, ok := resp.message(2)
+	if !ok || data.str(3) == "" {
+		return nil, fmt.Errorf("Google Play didn't deliver %s @ %d", pkg, versionCode)
+	}
+
+	delivery := &gplayDelivery{
+		apks: []gplayFile{{name: "base", url: data.str(3), size: int64(data.uint(1)), sha1: data.str(2)}},
+	}
+
+	for _, split := range data.messages(15) {
+		delivery.apks = append(delivery.apks, gplayFile{
+			name: split.str(1),
+			url:  split.str(5),
+			size: int64(split.uint(2)),
+			sha1: split.str(4),
+		})
+	}
+
+	for _, obb := range data.messages(4) {
+		kind := "main"
+		if obb.uint(1) == 1 {
+			kind = "patch"
+		}
+
+		delivery.obbs = append(delivery.obbs, gplayFile{
+			name: fmt.Sprintf("%s.%d.%s.obb", kind, obb.uint(2), pkg),
+			url:  obb.str(4),
+			size: int64(obb.uint(3)),
+		})
+	}
+
+	if cookie, ok := data.message(5); ok {
+		delivery.cookie = &http.Cookie{Name: cookie.str(1), Value: cookie.str(2)}
+	}
+
+	return delivery, nil
+}
+
+// download writes file to path, checking its SHA-1 if Google Play gave one.
+func (delivery *gplayDelivery) download(file gplayFile, path string) error {
+	req, err := http.NewRequest("GET", file.url, nil)
+	if err != nil {
+		return err
+	}
+	if delivery.cookie != nil {
+		req.AddCookie(delivery.cookie)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("download failed: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	h := sha1.New()
+	err = writeFileAtomic(path, func(w io.Writer) error {
+		_, err := io.Copy(io.MultiWriter(w, h), resp.Body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if file.sha1 == "" {
+		return nil
+	}
+
+	want, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(file.sha1, "="))
+	if err != nil {
+		log.Printf("[WARN] Not checking %s, invalid SHA-1 %q: %s", file.name, file.sha1, err)
+		return nil
+	}
+
+	if !bytes.Equal(want, h.Sum(nil)) {
+		os.Remove(path)
+		return fmt.Errorf("sha1 mismatch")
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package repo
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gplayTestServer stubs the API, delivering the APKs by split name ("base" for the base APK) at
+// versionCode 42, with the SHA-1s given or else their own.
+func gplayTestServer(t *testing.T, apks map[string][]byte, sha1s map[string]string, obb bool) *httptest.Server {
+	var srv *httptest.Server
+	wrap := func(payload ...[]byte) []byte { return pbTestMessage(1, payload...) }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fdfe/details", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("doc") != "org.example.app" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(wrap(pbTestMessage(2, pbTestMessage(4,
+			pbTestMessage(8, pbTestVarint(8, 1)),
+			pbTestMessage(13, pbTestMessage(1, pbTestVarint(3, 42), pbTestString(4, "4.2"))),
+		))))
+	})
+	mux.HandleFunc("/fdfe/purchase", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.PostFormValue("vc") != "42" {
+			t.Errorf("Purchased with %s %v", r.Method, r.PostForm)
+		}
+		w.Write(wrap(pbTestMessage(4, pbTestString(55, "token"))))
+	})
+	mux.HandleFunc("/fdfe/delivery", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("dtok") != "token" {
+			t.Errorf("Delivery requested without the purchase's download token: %v", r.URL.Query())
+		}
+
+		file := func(name string) (string, string) {
+			sum, ok := sha1s[name]
+			if !ok {
+				h := sha1.Sum(apks[name])
+				sum = base64.RawURLEncoding.EncodeToString(h[:])
+			}
+			return srv.URL + "/apk/" + name, sum
+		}
+
+		url, sum := file("base")
+		data := [][]byte{pbTestVarint(1, uint64(len(apks["base"]))), pbTestString(2, sum), pbTestString(3, url), pbTestMessage(5, pbTestString(1, "auth"), pbTestString(2, "cookie"))}
+		for name := range apks {
+			if name != "base" {
+				url, sum := file(name)
+				data = append(data, pbTestMessage(15, pbTestString(1, name), pbTestVarint(2, uint64(len(apks[name]))), pbTestString(4, sum), pbTestString(5, url)))
+			}
+		}
+		if obb {
+			data = append(data, pbTestMessage(4, pbTestVarint(1, 0), pbTestVarint(2, 42), pbTestString(4, srv.URL+"/obb")))
+		}
+		w.Write(wrap(pbTestMessage(21, pbTestVarint(1, 1), pbTestMessage(2, data...))))
+	})
+	mux.HandleFunc("/apk/", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("auth"); err != nil || c.Value != "cookie" {
+			t.Errorf("Downloaded %s without the delivery's cookie", r.URL.Path)
+		}
+		w.Write(apks[strings.TrimPrefix(r.URL.Path, "/apk/")])
+	})
+
+	srv = httptest.NewServer(mux)
+	return srv
+}
+
+func TestGPlayDownload(t *testing.T) {
+	apks := testSplitApks(t, testSigningKey(t))
+
+	defer func(url string) { gplayBaseURL = url }(gplayBaseURL)
+
+	for _, tc := range []struct {
+		name  string
+		sha1s map[string]string
+		obb   bool
+		err   string
+	}{
+		{name: "splits"},
+		{name: "sha1 mismatch", sha1s: map[string]string{"config.fr": "2jmj7l5rSw0yVb_vlWAYkK_YBwk"}, err: "Failed to download config.fr APK of org.example.app: sha1 mismatch"},
+		{name: "obb", obb: true, err: "org.example.app needs OBB expansion files (main.42.org.example.app.obb), which aren't supported"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := gplayTestServer(t, apks, tc.sha1s, tc.obb)
+			defer srv.Close()
+			gplayBaseURL = srv.URL + "/fdfe/"
+
+			useTestCache(t)
+
+			apk := &Apk{Name: "org.example.app"}
+			config := &GPlayConfig{Token: "token", GSFID: "1", DeviceProfile: GPlayDeviceProfile{}}
+			err := GPlayCLIPackage{apk, config}.UpdateCache(nil)
+
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("Got error %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(apk.Paths) != len(apks) || filepath.Base(*apk.BasePath) != "base.apk" {
+				t.Fatalf("Cached %v, want %d APKs, base first", apk.Paths, len(apks))
+			}
+			for _, path := range apk.Paths {
+				name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "split_"), ".apk")
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want, ok := apks[name]; !ok || string(data) != string(want) {
+					t.Errorf("Cached %s isn't what was delivered as %s", path, name)
+				}
+			}
+		})
+	}
+}
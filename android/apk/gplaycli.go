@@ -2,66 +2,134 @@ package repo
 
 import (
 	"fmt"
-	"github.com/adrg/xdg"
 	"log"
-	"mvdan.cc/fdroidcl/adb"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
+
+	"mvdan.cc/fdroidcl/adb"
 )
 
+// GPlayCLIPackage downloads from Google Play, as gplaycli did; the name's kept for compatibility.
 type GPlayCLIPackage struct {
-	apk *Apk
+	apk    *Apk
+	config *GPlayConfig
+}
+
+func init() {
+	RegisterMethod("gplaycli", func(apk *Apk, opts Options) APKAcquirer {
+		return RefreshedPackage{GPlayCLIPackage{apk, opts.GPlay}, "gplaycli", opts.RefreshInterval}
+	})
 }
 
 func (pkg GPlayCLIPackage) Apk() *Apk {
 	return pkg.apk
 }
 
-func (pkg GPlayCLIPackage) GetApkPaths(device *adb.Device, _ *int) ([]string, error) {
-	if pkg.Apk().Paths == nil {
+func (pkg GPlayCLIPackage) GetApkPaths(device *adb.Device, version *int) ([]string, error) {
+	if pkg.Apk().Paths != nil {
+		return pkg.Apk().Paths, nil
+	}
+
+	if version == nil || pkg.apk.Offline {
 		if err := pkg.UpdateCache(device); err != nil {
 			return nil, err
 		}
+		return pkg.Apk().Paths, nil
+	}
+
+	// Install what was planned, even if there's since been an update
+	client, err := newGPlayClient(pkg.config, device)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = pkg.fetch(client, *version, 1); err != nil {
+		return nil, err
 	}
 
 	return pkg.Apk().Paths, nil
 }
 
 func (pkg GPlayCLIPackage) UpdateCache(device *adb.Device) error {
-	apkDir, err := xdg.CacheFile("terraform-android/gplaycli")
+	if pkg.apk.Offline {
+		return updateFromCache(pkg.apk)
+	}
+
+	client, err := newGPlayClient(pkg.config, device)
 	if err != nil {
 		return err
 	}
 
-	err = os.MkdirAll(apkDir, 0775)
+	details, err := client.details(pkg.apk.Name)
+	if err != nil {
+		return fmt.Errorf("Failed to find %s on Google Play: %s", pkg.apk.Name, err)
+	}
+	log.Printf("[INFO] Google Play has %s %s (%d)", pkg.apk.Name, details.versionString, details.versionCode)
+
+	if !pkg.apk.VersionFilter.Allows(details.versionCode, details.versionString) {
+		return fmt.Errorf("Google Play has %s %s (%d), which does not satisfy %s", pkg.apk.Name, details.versionString, details.versionCode, pkg.apk.VersionFilter)
+	}
+
+	return pkg.fetch(client, details.versionCode, details.offerType)
+}
+
+// fetch downloads the version of the app, unless it's already cached (for the device profile).
+func (pkg GPlayCLIPackage) fetch(client *gplayClient, versionCode int, offerType int) error {
+	source := fmt.Sprintf("gplay:%s:%d:%s", pkg.apk.Name, versionCode, client.profile.key())
+	paths, ok, err := cachedBySource(source)
 	if err != nil {
 		return err
 	}
 
-	apkPath := fmt.Sprintf("%s/%s.apk", apkDir, pkg.apk.Name)
-	pkg.apk.BasePath = &apkPath
-	pkg.apk.Paths = []string{apkPath}
-
-	cmd := exec.Command("python", "-m", "gplaycli")
-	_, err = os.Stat(apkPath)
-	if os.IsNotExist(err) {
-		log.Println("[INFO] Downloading", pkg.apk.Name)
-		cmd.Args = append(cmd.Args, fmt.Sprint("--folder=", apkDir), fmt.Sprint("--download=", pkg.apk.Name))
-	} else {
-		log.Println("Updating cached packages")
-		cmd.Args = append(cmd.Args, fmt.Sprint("--update=", apkDir), "--yes")
+	if !ok {
+		if paths, err = pkg.download(client, versionCode, offerType, source); err != nil {
+			return err
+		}
+	}
+
+	pkg.apk.BasePath = &paths[0]
+	pkg.apk.Paths = paths
+	return nil
+}
+
+func (pkg GPlayCLIPackage) download(client *gplayClient, versionCode int, offerType int, source string) ([]string, error) {
+	delivery, err := client.delivery(pkg.apk.Name, versionCode, offerType)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download %s: %s", pkg.apk.Name, err)
+	}
+
+	if len(delivery.obbs) > 0 {
+		var names []string
+		for _, obb := range delivery.obbs {
+			names = append(names, obb.name)
+		}
+		return nil, fmt.Errorf("%s needs OBB expansion files (%s), which aren't supported", pkg.apk.Name, strings.Join(names, ", "))
 	}
 
-	stdouterr, err := cmd.CombinedOutput()
-	log.Println(string(stdouterr))
-	if strings.Contains(string(stdouterr), "No module named gplaycli") {
-		return fmt.Errorf("gplaycli is not installed (with this environment's `python`)")
+	stagingDir, err := cacheStagingDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	var paths []string
+	for _, apk := range delivery.apks {
+		path := filepath.Join(stagingDir, apk.name+".apk")
+
+		log.Printf("[INFO] Downloading %s APK of %s @ %d (%d bytes)", apk.name, pkg.apk.Name, versionCode, apk.size)
+		if err = delivery.download(apk, path); err != nil {
+			return nil, fmt.Errorf("Failed to download %s APK of %s: %s", apk.name, pkg.apk.Name, err)
+		}
+
+		paths = append(paths, path)
 	}
-	if err != nil || strings.Contains(string(stdouterr), "[ERROR]") {
-		return fmt.Errorf("Failed to download or update %s: %s", pkg.apk.Name, stdouterr)
+
+	paths, err = cacheStore(paths, source, pkg.apk.evictionLimits())
+	if err != nil {
+		return nil, err
 	}
 	log.Printf("[INFO] %s cached", pkg.apk.Name)
 
-	return nil
+	return paths, nil
 }
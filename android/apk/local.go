@@ -0,0 +1,91 @@
+package repo
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"mvdan.cc/fdroidcl/adb"
+)
+
+type LocalPackage struct {
+	apk     *Apk
+	path    string
+	signing *SigningKey
+}
+
+func init() {
+	RegisterMethod("local", func(apk *Apk, opts Options) APKAcquirer {
+		return LocalPackage{apk, opts.Path, opts.BundleSigningKey}
+	})
+}
+
+func (pkg LocalPackage) Apk() *Apk {
+	return pkg.apk
+}
+
+func (pkg LocalPackage) GetApkPaths(device *adb.Device, _ *int) ([]string, error) {
+	if pkg.Apk().Paths == nil {
+		if err := pkg.UpdateCache(device); err != nil {
+			return nil, err
+		}
+	}
+
+	return pkg.Apk().Paths, nil
+}
+
+func (pkg LocalPackage) UpdateCache(device *adb.Device) error {
+	if pkg.path == "" {
+		return fmt.Errorf("path required for local %s", pkg.apk.Name)
+	}
+
+	paths, err := localApkPaths(pkg.path, pkg.apk.evictionLimits())
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 1 && isAppBundle(paths[0]) {
+		if paths, err = buildBundleApks(paths[0], device, pkg.signing, pkg.apk.evictionLimits()); err != nil {
+			return err
+		}
+	}
+
+	basePath, err := findBaseApk(paths)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Found %s at %v", pkg.apk.Name, paths)
+	pkg.apk.BasePath = &basePath
+	pkg.apk.Paths = paths
+	return nil
+}
+
+// localApkPaths resolves a single APK, App Bundle or bundle archive, a directory of split APKs, or a glob.
+// A bundle archive is unpacked into the cache, bounded by limits.
+func localApkPaths(path string, limits CacheLimits) ([]string, error) {
+	stat, err := os.Stat(path)
+	if err == nil && !stat.IsDir() {
+		if isBundle(path) {
+			return unpackLocalBundle(path, limits)
+		}
+		return []string{path}, nil
+	}
+
+	pattern := path
+	if err == nil {
+		pattern = filepath.Join(path, "*.apk")
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No APKs found at %s", path)
+	}
+
+	return paths, nil
+}
@@ -0,0 +1,74 @@
+package repo
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestApks writes the APKs named as by testSplitApks into dir, as base.apk and
+// split_<name>.apk, and returns their paths by name.
+func writeTestApks(t *testing.T, dir string, apks map[string][]byte) map[string]string {
+	paths := make(map[string]string)
+	for name, data := range apks {
+		file := "split_" + name + ".apk"
+		if name == "base" {
+			file = "base.apk"
+		}
+
+		paths[name] = filepath.Join(dir, file)
+		if err := ioutil.WriteFile(paths[name], data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+func TestLocalPackage(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeTestApks(t, dir, testSplitApks(t, testSigningKey(t)))
+
+	for _, tc := range []struct {
+		name  string
+		path  string
+		paths []string
+		err   string
+	}{
+		{name: "apk", path: paths["base"], paths: []string{paths["base"]}},
+		{name: "directory", path: dir, paths: []string{paths["base"], paths["config.arm64_v8a"], paths["config.fr"], paths["config.xxhdpi"]}},
+		{name: "glob", path: filepath.Join(dir, "*[ae].apk"), paths: []string{paths["base"], paths["config.arm64_v8a"]}},
+		{name: "missing", path: filepath.Join(dir, "missing.apk"), err: "No APKs found at " + filepath.Join(dir, "missing.apk")},
+		{name: "no base", path: filepath.Join(dir, "split_*.apk"), err: "No base APK found among"},
+		{name: "unset", err: "path required for local org.example.app"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkg, err := Package([]string{"local"}, "org.example.app", Options{Path: tc.path})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = pkg.GetApkPaths(nil, nil)
+			if tc.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+					t.Fatalf("Got error %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *pkg.Apk().BasePath != paths["base"] {
+				t.Errorf("Got base %s, want %s", *pkg.Apk().BasePath, paths["base"])
+			}
+			if !equalStrings(pkg.Apk().Paths, tc.paths) {
+				t.Errorf("Got %v, want %v", pkg.Apk().Paths, tc.paths)
+			}
+
+			if version, err := Version(pkg); err != nil || version != 42 {
+				t.Errorf("Got versionCode %d (%v), want 42", version, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package repo
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// lockFile takes an exclusive lock on path, by way of path.lock, blocking until it's released by
+// any other process or goroutine holding it. The returned function releases it.
+func lockFile(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return nil, err
+	}
+
+	return lockPath(path + ".lock")
+}
+
+// writeFileAtomic writes to a temporary file alongside path and renames it into place, so that
+// concurrent readers see either the old or the new file, never one partially written.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err = write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func writeFileDataAtomic(path string, data []byte) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,53 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package repo
+
+import (
+	"os"
+	"time"
+)
+
+// Locks older than this are assumed to have been left by a process that died holding them; those
+// held are touched more often, however long they're held for (e.g. for a download)
+const staleLockAge = 10 * time.Minute
+
+const lockRefreshInterval = staleLockAge / 4
+
+func lockPath(lockPath string) (func(), error) {
+	for {
+		f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			f.Close()
+
+			released := make(chan struct{})
+			go func() {
+				ticker := time.NewTicker(lockRefreshInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case now := <-ticker.C:
+						os.Chtimes(lockPath, now, now)
+					case <-released:
+						return
+					}
+				}
+			}()
+
+			return func() {
+				close(released)
+				os.Remove(lockPath)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if stat, err := os.Stat(lockPath); err == nil && time.Since(stat.ModTime()) > staleLockAge {
+			os.Remove(lockPath)
+			continue
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	aapt "github.com/shogo82148/androidbinary/apk"
+)
+
+// Metadata describes the APKs that an APKAcquirer acquired, beyond their version.
+type Metadata struct {
+	Label            string
+	MinSdkVersion    int
+	TargetSdkVersion int
+	Permissions      []string
+	// ABIs with native libraries in any of the APKs
+	NativeABIs []string
+	// Hex-encoded SHA-256 of the base APK's signing certificate, empty if unsigned
+	SignerSha256 string
+	// Total size of the APKs, in bytes
+	Size int64
+	// Hex-encoded SHA-256 of the APKs' contents, concatenated in order of their file names
+	Sha256 string
+}
+
+func ReadMetadata(apk APKAcquirer) (*Metadata, error) {
+	if apk.Apk().BasePath == nil {
+		return nil, fmt.Errorf("Expected %s to exist, but path unset", apk.Apk().Name)
+	}
+
+	pkg, err := aapt.OpenFile(*apk.Apk().BasePath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s manifest: %s", apk.Apk().Name, err)
+	}
+	defer pkg.Close()
+
+	var meta Metadata
+	manifest := pkg.Manifest()
+
+	if meta.Label, err = pkg.Label(nil); err != nil {
+		log.Printf("[WARN] Failed to read %s label: %s", apk.Apk().Name, err)
+	}
+
+	minSdk, _ := manifest.SDK.Min.Int32()
+	targetSdk, _ := manifest.SDK.Target.Int32()
+	meta.MinSdkVersion, meta.TargetSdkVersion = int(minSdk), int(targetSdk)
+
+	for _, perm := range manifest.UsesPermissions {
+		name, err := perm.Name.String()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s permissions: %s", apk.Apk().Name, err)
+		}
+		meta.Permissions = append(meta.Permissions, name)
+	}
+	sort.Strings(meta.Permissions)
+
+	if _, certs, err := ApkSigners(*apk.Apk().BasePath); err != nil {
+		log.Printf("[WARN] Failed to verify %s signature: %s", apk.Apk().Name, err)
+	} else {
+		meta.SignerSha256 = certFingerprint(certs[0])
+	}
+
+	abis := make(map[string]bool)
+	for _, path := range apk.Apk().Paths {
+		if err = apkNativeABIs(path, abis); err != nil {
+			return nil, err
+		}
+	}
+
+	if meta.Sha256, meta.Size, err = apksSha256(apk.Apk().Paths); err != nil {
+		return nil, err
+	}
+
+	for abi := range abis {
+		meta.NativeABIs = append(meta.NativeABIs, abi)
+	}
+	sort.Strings(meta.NativeABIs)
+
+	return &meta, nil
+}
+
+// apksSha256 is the hex-encoded SHA-256 of the APKs' contents, concatenated in order of their file
+// names, and their total size.
+func apksSha256(paths []string) (string, int64, error) {
+	paths = append([]string{}, paths...)
+	sort.Slice(paths, func(i, j int) bool {
+		return filepath.Base(paths[i]) < filepath.Base(paths[j])
+	})
+
+	h := sha256.New()
+	var size int64
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", 0, err
+		}
+
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", 0, err
+		}
+		size += n
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// apkNativeABIs adds the ABIs for which the APK contains native libraries, i.e. lib/<abi>/*.so.
+func apkNativeABIs(path string, abis map[string]bool) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if parts := strings.Split(f.Name, "/"); len(parts) == 3 && parts[0] == "lib" && strings.HasSuffix(parts[2], ".so") {
+			abis[parts[1]] = true
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package repo
+
+import (
+	"fmt"
+	"log"
+
+	aapt "github.com/shogo82148/androidbinary/apk"
+)
+
+func errNotCached(what string) error {
+	return fmt.Errorf("%s is not cached, and the provider is offline: acquire it once while online to seed the cache", what)
+}
+
+// cachedNewest returns the cached APKs of the package with the highest versionCode that filter
+// allows, from any source.
+func cachedNewest(pkg string, filter *VersionFilter) ([]string, bool, error) {
+	return cacheLookup(func(entry *cacheEntry) bool {
+		if entry.Package != pkg {
+			return false
+		}
+		if filter == nil {
+			return true
+		}
+
+		dir, err := apkCacheDir()
+		if err != nil {
+			return false
+		}
+
+		base, err := aapt.OpenFile(entry.paths(dir)[0])
+		if err != nil {
+			log.Printf("[WARN] Failed to read cached %s @ %d: %s", entry.Package, entry.VersionCode, err)
+			return false
+		}
+		defer base.Close()
+
+		versionName, _ := base.Manifest().VersionName.String()
+		return filter.Allows(entry.VersionCode, versionName)
+	})
+}
+
+// updateFromCache is UpdateCache for methods that can't tell what's available without going
+// online, so offline install the newest version that's cached.
+func updateFromCache(apk *Apk) error {
+	paths, ok, err := cachedNewest(apk.Name, apk.VersionFilter)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errNotCached(fmt.Sprintf("%s (%s)", apk.Name, apk.VersionFilter))
+	}
+
+	log.Printf("[INFO] Offline, using cached %s", apk.Name)
+	apk.BasePath = &paths[0]
+	apk.Paths = paths
+	return nil
+}
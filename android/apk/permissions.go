@@ -0,0 +1,44 @@
+package repo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PermissionPolicy restricts the permissions that an APK may request. Permissions may be given
+// in full, or without the `android.permission.` prefix for those defined by the platform.
+type PermissionPolicy struct {
+	// If non-empty, the only permissions that may be requested
+	Allowed []string
+	// Permissions that may not be requested
+	Denied []string
+}
+
+func permissionSet(permissions []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, perm := range permissions {
+		if !strings.Contains(perm, ".") {
+			perm = "android.permission." + perm
+		}
+		set[perm] = true
+	}
+	return set
+}
+
+// Check fails with every permission that the policy doesn't allow.
+func (p PermissionPolicy) Check(pkg string, permissions []string) error {
+	allowed, denied := permissionSet(p.Allowed), permissionSet(p.Denied)
+
+	var violations []string
+	for _, perm := range permissions {
+		if denied[perm] || (len(allowed) > 0 && !allowed[perm]) {
+			violations = append(violations, perm)
+		}
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("%s requests permissions not allowed by policy: %s", pkg, strings.Join(violations, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package repo
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pbMessage is a decoded protobuf message, for reading the few fields that are needed of an API
+// without its generated code. Fields of 64-bit fixed-width types are skipped.
+type pbMessage struct {
+	varints  map[protowire.Number][]uint64
+	bytes    map[protowire.Number][][]byte
+	fixed32s map[protowire.Number][]uint32
+}
+
+func parsePB(data []byte) (pbMessage, error) {
+	m := pbMessage{
+		varints:  make(map[protowire.Number][]uint64),
+		bytes:    make(map[protowire.Number][][]byte),
+		fixed32s: make(map[protowire.Number][]uint32),
+	}
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return m, fmt.Errorf("invalid protobuf: %s", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return m, fmt.Errorf("invalid protobuf: %s", protowire.ParseError(n))
+			}
+			m.varints[num] = append(m.varints[num], v)
+			data = data[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return m, fmt.Errorf("invalid protobuf: %s", protowire.ParseError(n))
+			}
+			m.bytes[num] = append(m.bytes[num], v)
+			data = data[n:]
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(data)
+			if n < 0 {
+				return m, fmt.Errorf("invalid protobuf: %s", protowire.ParseError(n))
+			}
+			m.fixed32s[num] = append(m.fixed32s[num], v)
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return m, fmt.Errorf("invalid protobuf: %s", protowire.ParseError(n))
+			}
+			data = data[n:]
+		}
+	}
+
+	return m, nil
+}
+
+// message returns the embedded message at path, following the first of any repeated field.
+func (m pbMessage) message(path ...protowire.Number) (pbMessage, bool) {
+	for _, num := range path {
+		values := m.bytes[num]
+		if len(values) == 0 {
+			return pbMessage{}, false
+		}
+
+		var err error
+		if m, err = parsePB(values[0]); err != nil {
+			return pbMessage{}, false
+		}
+	}
+
+	return m, true
+}
+
+func (m pbMessage) messages(num protowire.Number) []pbMessage {
+	var messages []pbMessage
+	for _, value := range m.bytes[num] {
+		if msg, err := parsePB(value); err == nil {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func (m pbMessage) str(num protowire.Number) string {
+	if values := m.bytes[num]; len(values) > 0 {
+		return string(values[len(values)-1])
+	}
+	return ""
+}
+
+func (m pbMessage) uint(num protowire.Number) uint64 {
+	if values := m.varints[num]; len(values) > 0 {
+		return values[len(values)-1]
+	}
+	return 0
+}
+
+func (m pbMessage) fixed32(num protowire.Number) uint32 {
+	if values := m.fixed32s[num]; len(values) > 0 {
+		return values[len(values)-1]
+	}
+	return 0
+}
+
+// has reports whether the field is set, as a oneof's is even if it's the zero value.
+func (m pbMessage) has(num protowire.Number) bool {
+	return len(m.varints[num]) > 0 || len(m.bytes[num]) > 0 || len(m.fixed32s[num]) > 0
+}
@@ -0,0 +1,169 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adrg/xdg"
+	"mvdan.cc/fdroidcl/adb"
+)
+
+// Checking a package's source for updates can be slow (loading an F-Droid index, or driving
+// AuroraStore on the device) so within the refresh interval of the last check, what it found
+// is reused from the cache instead.
+
+type packageCheck struct {
+	Package string    `json:"package"`
+	Checked time.Time `json:"checked"`
+	// Paths in the APK cache of what was found, base APK first
+	Paths []string `json:"paths"`
+}
+
+func packageChecksPath() (string, error) {
+	return xdg.CacheFile("terraform-android/checks.json")
+}
+
+func loadPackageChecks(path string) (map[string]*packageCheck, error) {
+	checks := make(map[string]*packageCheck)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &checks); err != nil || checks == nil {
+		log.Printf("[WARN] Ignoring corrupt record of package update checks: %v", err)
+		return make(map[string]*packageCheck), nil
+	}
+
+	return checks, nil
+}
+
+// RefreshedPackage is an APKAcquirer whose UpdateCache only checks its source for updates if
+// it hasn't within the refresh interval.
+type RefreshedPackage struct {
+	APKAcquirer
+	// Identifies the source, along with the device and version filter when UpdateCache is called
+	source string
+	// Time since the last check within which the source isn't checked again, zero to always check
+	interval time.Duration
+}
+
+func (pkg RefreshedPackage) checkKey(device *adb.Device) string {
+	var deviceID string
+	if device != nil {
+		deviceID = device.ID
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s\n%s", pkg.source, pkg.Apk().Name, pkg.Apk().VersionFilter, deviceID)))
+	return hex.EncodeToString(sum[:])
+}
+
+// lastChecked returns the APKs found by the last check, if it was within the refresh interval
+// and they're still cached.
+func (pkg RefreshedPackage) lastChecked(key string) ([]string, bool, error) {
+	path, err := packageChecksPath()
+	if err != nil {
+		return nil, false, err
+	}
+
+	checks, err := loadPackageChecks(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	check, ok := checks[key]
+	if !ok || len(check.Paths) == 0 || time.Since(check.Checked) > pkg.interval {
+		return nil, false, nil
+	}
+
+	dir, err := apkCacheDir()
+	if err != nil {
+		return nil, false, err
+	}
+
+	paths, ok, err := cacheLookup(func(entry *cacheEntry) bool {
+		return strings.Join(entry.paths(dir), "\n") == strings.Join(check.Paths, "\n")
+	})
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	log.Printf("[INFO] Not checking for updates to %s, last checked %s", pkg.Apk().Name, check.Checked)
+	return paths, true, nil
+}
+
+func (pkg RefreshedPackage) recordCheck(key string) error {
+	path, err := packageChecksPath()
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	checks, err := loadPackageChecks(path)
+	if err != nil {
+		return err
+	}
+
+	for k, check := range checks {
+		if time.Since(check.Checked) > pkg.interval {
+			delete(checks, k)
+		}
+	}
+
+	checks[key] = &packageCheck{
+		Package: pkg.Apk().Name,
+		Checked: time.Now(),
+		Paths:   pkg.Apk().Paths,
+	}
+
+	data, err := json.MarshalIndent(checks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileDataAtomic(path, data)
+}
+
+func (pkg RefreshedPackage) UpdateCache(device *adb.Device) error {
+	if pkg.interval <= 0 || pkg.Apk().Offline {
+		return pkg.APKAcquirer.UpdateCache(device)
+	}
+
+	key := pkg.checkKey(device)
+	paths, ok, err := pkg.lastChecked(key)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		pkg.Apk().BasePath = &paths[0]
+		pkg.Apk().Paths = paths
+		return nil
+	}
+
+	if err = pkg.APKAcquirer.UpdateCache(device); err != nil {
+		return err
+	}
+
+	if err = pkg.recordCheck(key); err != nil {
+		log.Printf("[WARN] Failed to record update check of %s: %s", pkg.Apk().Name, err)
+	}
+
+	return nil
+}
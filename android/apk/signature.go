@@ -0,0 +1,410 @@
+package repo
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+const (
+	apkSigV3BlockID = 0xf05368c0
+
+	apkSigRSAPSSSHA256    = 0x0101
+	apkSigRSAPSSSHA512    = 0x0102
+	apkSigRSAPKCS1SHA512  = 0x0104
+	apkSigECDSASHA512     = 0x0202
+	zipEOCDCommentOffset  = 20
+	zipEOCDMaxCommentSize = 0xffff
+)
+
+// apkSigAlgorithm is a signature algorithm of the APK Signature Scheme v2/v3 that we can verify.
+type apkSigAlgorithm struct {
+	hash crypto.Hash
+	pss  bool
+}
+
+// Preferred first; DSA and the verity-chunked variants aren't supported.
+var apkSigAlgorithms = []uint32{
+	apkSigRSAPSSSHA512,
+	apkSigRSAPKCS1SHA512,
+	apkSigECDSASHA512,
+	apkSigRSAPSSSHA256,
+	apkSigRSAPKCS1SHA256,
+	apkSigECDSASHA256,
+}
+
+var apkSigAlgorithmParams = map[uint32]apkSigAlgorithm{
+	apkSigRSAPSSSHA256:   {crypto.SHA256, true},
+	apkSigRSAPSSSHA512:   {crypto.SHA512, true},
+	apkSigRSAPKCS1SHA256: {crypto.SHA256, false},
+	apkSigRSAPKCS1SHA512: {crypto.SHA512, false},
+	apkSigECDSASHA256:    {crypto.SHA256, false},
+	apkSigECDSASHA512:    {crypto.SHA512, false},
+}
+
+// sigReader reads the little-endian, length-prefixed structures of the APK Signing Block.
+type sigReader []byte
+
+func (r *sigReader) uint32() (uint32, error) {
+	if len(*r) < 4 {
+		return 0, fmt.Errorf("truncated signing block")
+	}
+	v := binary.LittleEndian.Uint32(*r)
+	*r = (*r)[4:]
+	return v, nil
+}
+
+func (r *sigReader) lengthPrefixed() (sigReader, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(*r)) < n {
+		return nil, fmt.Errorf("truncated signing block")
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, nil
+}
+
+// apkSections locates the APK Signing Block, and returns the parts of the APK that v2/v3 digests
+// cover: the entries before the block, the central directory, and the EOCD as though the central
+// directory started where the block does. block is nil if there is no APK Signing Block.
+func apkSections(apk []byte) (block []byte, entries []byte, cd []byte, eocd []byte, err error) {
+	eocdOffset := -1
+	for i := len(apk) - zipEOCDSize; i >= 0 && i >= len(apk)-zipEOCDSize-zipEOCDMaxCommentSize; i-- {
+		if binary.LittleEndian.Uint32(apk[i:]) == 0x06054b50 &&
+			i+zipEOCDSize+int(binary.LittleEndian.Uint16(apk[i+zipEOCDCommentOffset:])) == len(apk) {
+			eocdOffset = i
+			break
+		}
+	}
+	if eocdOffset < 0 {
+		return nil, nil, nil, nil, fmt.Errorf("zip end of central directory not found")
+	}
+
+	cdOffset := int(binary.LittleEndian.Uint32(apk[eocdOffset+zipEOCDCDOffsetOffset:]))
+	if cdOffset > eocdOffset {
+		return nil, nil, nil, nil, fmt.Errorf("invalid central directory offset")
+	}
+	cd = apk[cdOffset:eocdOffset]
+
+	if cdOffset < 24 || string(apk[cdOffset-len(apkSigBlockMagic):cdOffset]) != apkSigBlockMagic {
+		return nil, nil, nil, nil, nil
+	}
+
+	// The size excludes its leading copy, but includes the trailing copy and magic
+	blockSize := binary.LittleEndian.Uint64(apk[cdOffset-24:])
+	if blockSize < 24 || blockSize > uint64(cdOffset-8) {
+		return nil, nil, nil, nil, fmt.Errorf("invalid APK Signing Block size")
+	}
+
+	blockOffset := cdOffset - int(blockSize) - 8
+	if binary.LittleEndian.Uint64(apk[blockOffset:]) != blockSize {
+		return nil, nil, nil, nil, fmt.Errorf("APK Signing Block sizes differ")
+	}
+
+	eocd = append([]byte{}, apk[eocdOffset:]...)
+	binary.LittleEndian.PutUint32(eocd[zipEOCDCDOffsetOffset:], uint32(blockOffset))
+
+	return apk[blockOffset+8 : cdOffset-24], apk[:blockOffset], cd, eocd, nil
+}
+
+// signingBlockValue finds the ID-value pair with the given ID in the APK Signing Block.
+func signingBlockValue(block []byte, id uint32) ([]byte, error) {
+	for len(block) > 0 {
+		if len(block) < 12 {
+			return nil, fmt.Errorf("truncated signing block")
+		}
+
+		n := binary.LittleEndian.Uint64(block)
+		if n < 4 || n > uint64(len(block)-8) {
+			return nil, fmt.Errorf("invalid signing block pair size")
+		}
+
+		if binary.LittleEndian.Uint32(block[8:]) == id {
+			return block[12 : 8+n], nil
+		}
+		block = block[8+n:]
+	}
+
+	return nil, nil
+}
+
+func verifyApkSig(cert *x509.Certificate, algorithm apkSigAlgorithm, data []byte, sig []byte) error {
+	h := algorithm.hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if algorithm.pss {
+			return rsa.VerifyPSS(pub, algorithm.hash, digest, sig, &rsa.PSSOptions{SaltLength: algorithm.hash.Size()})
+		}
+		return rsa.VerifyPKCS1v15(pub, algorithm.hash, digest, sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			return fmt.Errorf("ECDSA verification failure")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key %T", pub)
+	}
+}
+
+// verifyApkSigner verifies one signer of a v2 or v3 signature, returning its certificate.
+func verifyApkSigner(signer sigReader, v3 bool, contentDigest func(crypto.Hash) []byte) (*x509.Certificate, error) {
+	signedData, err := signer.lengthPrefixed()
+	if err != nil {
+		return nil, err
+	}
+
+	if v3 {
+		// minSdkVersion, maxSdkVersion
+		if _, err = signer.uint32(); err != nil {
+			return nil, err
+		}
+		if _, err = signer.uint32(); err != nil {
+			return nil, err
+		}
+	}
+
+	signatures, err := signer.lengthPrefixed()
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := signer.lengthPrefixed()
+	if err != nil {
+		return nil, err
+	}
+
+	sigs := make(map[uint32][]byte)
+	for len(signatures) > 0 {
+		s, err := signatures.lengthPrefixed()
+		if err != nil {
+			return nil, err
+		}
+		id, err := s.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if sigs[id], err = s.lengthPrefixed(); err != nil {
+			return nil, err
+		}
+	}
+
+	var algorithmID uint32
+	for _, id := range apkSigAlgorithms {
+		if _, ok := sigs[id]; ok {
+			algorithmID = id
+			break
+		}
+	}
+	if algorithmID == 0 {
+		return nil, fmt.Errorf("no supported signature algorithm")
+	}
+	algorithm := apkSigAlgorithmParams[algorithmID]
+
+	data := signedData
+	digests, err := data.lengthPrefixed()
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := data.lengthPrefixed()
+	if err != nil {
+		return nil, err
+	}
+
+	rawCert, err := certs.lengthPrefixed()
+	if err != nil {
+		return nil, fmt.Errorf("no certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(rawCert)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(cert.RawSubjectPublicKeyInfo, publicKey) {
+		return nil, fmt.Errorf("certificate doesn't match signer's public key")
+	}
+
+	if err = verifyApkSig(cert, algorithm, signedData, sigs[algorithmID]); err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+
+	for len(digests) > 0 {
+		d, err := digests.lengthPrefixed()
+		if err != nil {
+			return nil, err
+		}
+		id, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if id != algorithmID {
+			continue
+		}
+
+		digest, err := d.lengthPrefixed()
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(digest, contentDigest(algorithm.hash)) {
+			return nil, fmt.Errorf("APK contents don't match digest")
+		}
+		return cert, nil
+	}
+
+	return nil, fmt.Errorf("no digest for signature algorithm %#x", algorithmID)
+}
+
+// verifyApkSignatureScheme verifies the v2 or v3 signature in the APK Signing Block, returning the signers.
+func verifyApkSignatureScheme(value []byte, v3 bool, contentDigest func(crypto.Hash) []byte) ([]*x509.Certificate, error) {
+	r := sigReader(value)
+	signers, err := r.lengthPrefixed()
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for len(signers) > 0 {
+		signer, err := signers.lengthPrefixed()
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := verifyApkSigner(signer, v3, contentDigest)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no signers")
+	}
+
+	return certs, nil
+}
+
+// verifyApkV1 verifies a JAR signature, which must cover every entry outside META-INF.
+func verifyApkV1(apk []byte) (*x509.Certificate, error) {
+	zr, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := verifyJarSignature(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range zr.File {
+		if strings.HasPrefix(f.Name, "META-INF/") || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+
+		if err = js.verifyEntry(zr, f.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	return js.cert, nil
+}
+
+// ApkSigners verifies the APK's signature with the newest scheme it has (v3, v2, then v1), as
+// Android would, and returns the scheme and the signers' certificates.
+func ApkSigners(path string) (string, []*x509.Certificate, error) {
+	apk, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	block, entries, cd, eocd, err := apkSections(apk)
+	if err != nil {
+		return "", nil, err
+	}
+
+	digests := make(map[crypto.Hash][]byte)
+	contentDigest := func(h crypto.Hash) []byte {
+		if _, ok := digests[h]; !ok {
+			newHash := sha256.New
+			if h == crypto.SHA512 {
+				newHash = sha512.New
+			}
+			digests[h] = apkContentDigest(newHash, entries, cd, eocd)
+		}
+		return digests[h]
+	}
+
+	for _, scheme := range []struct {
+		name string
+		id   uint32
+	}{
+		{"v3", apkSigV3BlockID},
+		{"v2", apkSigV2BlockID},
+	} {
+		value, err := signingBlockValue(block, scheme.id)
+		if err != nil {
+			return "", nil, err
+		}
+		if value == nil {
+			continue
+		}
+
+		certs, err := verifyApkSignatureScheme(value, scheme.id == apkSigV3BlockID, contentDigest)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid %s signature: %s", scheme.name, err)
+		}
+		return scheme.name, certs, nil
+	}
+
+	cert, err := verifyApkV1(apk)
+	if err != nil {
+		return "", nil, fmt.Errorf("Invalid v1 signature: %s", err)
+	}
+	return "v1", []*x509.Certificate{cert}, nil
+}
+
+// CheckSigner fails if any of the APKs that apk acquired isn't signed only by certificates
+// with the SHA-256 fingerprints in its Signers, if any are set.
+func CheckSigner(apk APKAcquirer) error {
+	if len(apk.Apk().Signers) == 0 {
+		return nil
+	}
+
+	allowed := make(map[string]bool)
+	for _, fingerprint := range apk.Apk().Signers {
+		allowed[normaliseFingerprint(fingerprint)] = true
+	}
+
+	for _, path := range apk.Apk().Paths {
+		scheme, certs, err := ApkSigners(path)
+		if err != nil {
+			return fmt.Errorf("Failed to verify signature of %s: %s", path, err)
+		}
+
+		for _, cert := range certs {
+			if fingerprint := certFingerprint(cert); !allowed[fingerprint] {
+				return fmt.Errorf("%s is signed (%s) by %s, which is not an allowed signer", path, scheme, fingerprint)
+			}
+		}
+		log.Printf("[DEBUG] Verified %s signature of %s", scheme, path)
+	}
+
+	return nil
+}
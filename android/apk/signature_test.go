@@ -0,0 +1,69 @@
+package repo
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// testZip lays out entries, an APK Signing Block of pairs with the given sizes (or none if
+// pairs is nil), a central directory, and the EOCD.
+func testZip(pairs []byte, leadingSize uint64, trailingSize uint64) []byte {
+	apk := []byte("PK\x03\x04entries")
+
+	if pairs != nil {
+		apk = appendUint64(apk, leadingSize)
+		apk = append(apk, pairs...)
+		apk = appendUint64(apk, trailingSize)
+		apk = append(apk, apkSigBlockMagic...)
+	}
+
+	cdOffset := len(apk)
+	apk = append(apk, "PK\x01\x02cd"...)
+
+	eocd := make([]byte, zipEOCDSize)
+	binary.LittleEndian.PutUint32(eocd, 0x06054b50)
+	binary.LittleEndian.PutUint32(eocd[zipEOCDCDOffsetOffset:], uint32(cdOffset))
+	return append(apk, eocd...)
+}
+
+func TestApkSections(t *testing.T) {
+	pair := []byte{8, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 'v', 'a', 'l', 'u'}
+	size := uint64(len(pair) + 24)
+
+	undersized := testZip(pair, size, size)
+	binary.LittleEndian.PutUint64(undersized[len("PK\x03\x04entries")+len(pair)+8:], 16)
+
+	tests := []struct {
+		name      string
+		apk       []byte
+		wantBlock []byte
+		wantErr   bool
+	}{
+		{"unsigned", testZip(nil, 0, 0), nil, false},
+		{"signed", testZip(pair, size, size), pair, false},
+		{"undersized block", undersized, nil, true},
+		{"zero-sized block", testZip(pair, 0, 0), nil, true},
+		{"oversized block", testZip(pair, size, 1<<40), nil, true},
+		{"sizes differ", testZip(pair, size+1, size), nil, true},
+		{"no EOCD", []byte("PK\x03\x04entries"), nil, true},
+		{"truncated", testZip(pair, size, size)[20:], nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block, _, _, _, err := apkSections(tt.apk)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if string(block) != string(tt.wantBlock) {
+				t.Errorf("block = %q, want %q", block, tt.wantBlock)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package repo
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shogo82148/androidbinary"
+)
+
+type splitManifest struct {
+	Package string `xml:"package,attr"`
+	Split   string `xml:"split,attr"`
+}
+
+func readSplitManifest(path string) (*splitManifest, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.Name != "AndroidManifest.xml" {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+
+		xmlfile, err := androidbinary.NewXMLFile(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		var m splitManifest
+		if err = xmlfile.Decode(&m, nil, nil); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}
+
+	return nil, fmt.Errorf("No AndroidManifest.xml in %s", path)
+}
+
+// findBaseApk returns the one path of a split set whose manifest doesn't declare a `split`.
+func findBaseApk(paths []string) (string, error) {
+	if len(paths) == 1 {
+		return paths[0], nil
+	}
+
+	var base string
+	for _, path := range paths {
+		m, err := readSplitManifest(path)
+		if err != nil {
+			return "", fmt.Errorf("Failed to read %s: %s", path, err)
+		}
+
+		if m.Split == "" {
+			if base != "" {
+				return "", fmt.Errorf("Found multiple base APKs: %s, %s", base, path)
+			}
+			base = path
+		}
+	}
+
+	if base == "" {
+		return "", fmt.Errorf("No base APK found among %v", paths)
+	}
+
+	return base, nil
+}
+
+// DeviceSpec is what's needed of a device to choose between configuration splits.
+type DeviceSpec struct {
+	ABIs     []string
+	Density  int
+	Locales  []string
+	APILevel int
+}
+
+// DeviceSpecFromProps reads a DeviceSpec from `getprop`.
+func DeviceSpecFromProps(props map[string]string) DeviceSpec {
+	spec := DeviceSpec{}
+
+	if abilist := props["ro.product.cpu.abilist"]; abilist != "" {
+		spec.ABIs = strings.Split(abilist, ",")
+	} else if abi := props["ro.product.cpu.abi"]; abi != "" {
+		spec.ABIs = []string{abi}
+		if abi2 := props["ro.product.cpu.abi2"]; abi2 != "" {
+			spec.ABIs = append(spec.ABIs, abi2)
+		}
+	}
+
+	spec.Density, _ = strconv.Atoi(props["ro.sf.lcd_density"])
+	spec.APILevel, _ = strconv.Atoi(props["ro.build.version.sdk"])
+
+	for _, prop := range []string{"persist.sys.locale", "ro.product.locale"} {
+		if locale := props[prop]; locale != "" {
+			spec.Locales = append(spec.Locales, locale)
+		}
+	}
+	if lang := props["ro.product.locale.language"]; lang != "" {
+		spec.Locales = append(spec.Locales, lang)
+	}
+
+	return spec
+}
+
+var abiSplits = map[string]bool{
+	"armeabi":     true,
+	"armeabi_v7a": true,
+	"arm64_v8a":   true,
+	"x86":         true,
+	"x86_64":      true,
+	"mips":        true,
+	"mips64":      true,
+}
+
+var densitySplits = map[string]int{
+	"ldpi":    120,
+	"mdpi":    160,
+	"tvdpi":   213,
+	"hdpi":    240,
+	"xhdpi":   320,
+	"xxhdpi":  480,
+	"xxxhdpi": 640,
+}
+
+var languageSplitRe = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// splitName is the configuration split's name from its manifest, e.g. `config.arm64_v8a`,
+// falling back to its file name, e.g. `split_config.arm64_v8a.apk`.
+func splitName(path string) string {
+	if m, err := readSplitManifest(path); err == nil {
+		return m.Split
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), ".apk")
+	if i := strings.Index(name, "config."); i >= 0 {
+		return name[i:]
+	}
+	return name
+}
+
+// SelectSplits drops the configuration splits that don't apply to spec: all but the best
+// matching ABI and nearest density, and languages the device isn't set to, if it's set to any.
+// The base APK, feature splits, and any unrecognised configuration splits are kept.
+func SelectSplits(paths []string, spec DeviceSpec) ([]string, error) {
+	if len(paths) <= 1 {
+		return paths, nil
+	}
+
+	abis := make(map[string]string)
+	densities := make(map[string]string)
+	languages := make(map[string][]string)
+	var selected []string
+
+	for _, path := range paths {
+		name := splitName(path)
+		if !strings.HasPrefix(name, "config.") {
+			selected = append(selected, path)
+			continue
+		}
+
+		config := strings.TrimPrefix(name, "config.")
+		switch {
+		case abiSplits[config]:
+			abis[config] = path
+		case densitySplits[config] > 0:
+			densities[config] = path
+		case languageSplitRe.MatchString(config):
+			languages[config] = append(languages[config], path)
+		default:
+			selected = append(selected, path)
+		}
+	}
+
+	if len(abis) > 0 {
+		var found bool
+		for _, abi := range spec.ABIs {
+			if path, ok := abis[strings.ReplaceAll(abi, "-", "_")]; ok {
+				selected = append(selected, path)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No split APK for device ABIs %v", spec.ABIs)
+		}
+	}
+
+	if len(densities) > 0 {
+		if spec.Density == 0 {
+			log.Println("[WARN] Device density unknown, installing all density splits")
+			for _, path := range densities {
+				selected = append(selected, path)
+			}
+		} else {
+			// Prefer the smallest density at least that of the device, else the largest
+			var best string
+			for config := range densities {
+				d, bestD := densitySplits[config], densitySplits[best]
+				switch {
+				case best == "":
+					best = config
+				case bestD < spec.Density && d > bestD:
+					best = config
+				case d >= spec.Density && d < bestD:
+					best = config
+				}
+			}
+			selected = append(selected, densities[best])
+		}
+	}
+
+	if len(languages) > 0 && len(spec.Locales) == 0 {
+		log.Println("[WARN] Device locale unknown, installing all language splits")
+		for _, paths := range languages {
+			selected = append(selected, paths...)
+		}
+	}
+
+	for _, locale := range spec.Locales {
+		lang := strings.ToLower(strings.SplitN(strings.ReplaceAll(locale, "_", "-"), "-", 2)[0])
+		selected = append(selected, languages[lang]...)
+		delete(languages, lang)
+	}
+
+	log.Printf("[DEBUG] Selected %v of splits %v for %+v", selected, paths, spec)
+	return selected, nil
+}
@@ -0,0 +1,167 @@
+package repo
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSelectSplits(t *testing.T) {
+	dir := t.TempDir()
+	apk := func(name string) string {
+		if name == "base" {
+			return filepath.Join(dir, "base.apk")
+		}
+		return filepath.Join(dir, "split_"+name+".apk")
+	}
+
+	// Named by file, as they have no manifests
+	all := []string{"base", "feature", "config.vulkan", "config.arm64_v8a", "config.armeabi_v7a", "config.x86_64", "config.mdpi", "config.xhdpi", "config.xxhdpi", "config.xxxhdpi", "config.fr", "config.de", "config.en"}
+
+	for _, tc := range []struct {
+		name   string
+		splits []string
+		spec   DeviceSpec
+		want   []string
+		err    string
+	}{
+		{
+			name: "device",
+			spec: DeviceSpec{ABIs: []string{"arm64-v8a", "armeabi-v7a"}, Density: 440, Locales: []string{"fr-FR"}},
+			want: []string{"base", "feature", "config.vulkan", "config.arm64_v8a", "config.xxhdpi", "config.fr"},
+		},
+		{
+			name: "preferred ABI",
+			spec: DeviceSpec{ABIs: []string{"x86_64", "arm64-v8a"}, Density: 320, Locales: []string{"en"}},
+			want: []string{"base", "feature", "config.vulkan", "config.x86_64", "config.xhdpi", "config.en"},
+		},
+		{
+			name:   "fallback ABI",
+			splits: []string{"base", "config.armeabi_v7a", "config.x86"},
+			spec:   DeviceSpec{ABIs: []string{"arm64-v8a", "armeabi-v7a", "armeabi"}},
+			want:   []string{"base", "config.armeabi_v7a"},
+		},
+		{
+			name:   "no ABI",
+			splits: []string{"base", "config.x86", "config.x86_64"},
+			spec:   DeviceSpec{ABIs: []string{"arm64-v8a"}},
+			err:    "No split APK for device ABIs [arm64-v8a]",
+		},
+		{
+			name:   "density above all",
+			splits: []string{"base", "config.mdpi", "config.xhdpi", "config.xxhdpi"},
+			spec:   DeviceSpec{Density: 640},
+			want:   []string{"base", "config.xxhdpi"},
+		},
+		{
+			name:   "density below all",
+			splits: []string{"base", "config.xhdpi", "config.xxhdpi"},
+			spec:   DeviceSpec{Density: 120},
+			want:   []string{"base", "config.xhdpi"},
+		},
+		{
+			name:   "unknown density",
+			splits: []string{"base", "config.xhdpi", "config.xxhdpi"},
+			want:   []string{"base", "config.xhdpi", "config.xxhdpi"},
+		},
+		{
+			name:   "several locales",
+			splits: []string{"base", "config.fr", "config.de", "config.en"},
+			spec:   DeviceSpec{Locales: []string{"de_AT", "FR"}},
+			want:   []string{"base", "config.de", "config.fr"},
+		},
+		{
+			name:   "locale without a split",
+			splits: []string{"base", "config.fr", "config.de"},
+			spec:   DeviceSpec{Locales: []string{"es-ES"}},
+			want:   []string{"base"},
+		},
+		{
+			name:   "unknown locale",
+			splits: []string{"base", "config.fr", "config.de"},
+			want:   []string{"base", "config.fr", "config.de"},
+		},
+		{
+			name:   "single APK",
+			splits: []string{"config.fr"},
+			spec:   DeviceSpec{Locales: []string{"de"}},
+			want:   []string{"config.fr"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			splits := tc.splits
+			if splits == nil {
+				splits = all
+			}
+
+			var paths []string
+			for _, split := range splits {
+				paths = append(paths, apk(split))
+			}
+
+			selected, err := SelectSplits(paths, tc.spec)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("Got error %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got, want []string
+			for _, path := range selected {
+				got = append(got, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "split_"), ".apk"))
+			}
+			want = append(want, tc.want...)
+			sort.Strings(got)
+			sort.Strings(want)
+			if !equalStrings(got, want) {
+				t.Errorf("Selected %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDeviceSpecFromProps(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		props map[string]string
+		want  DeviceSpec
+	}{
+		{
+			name: "abilist",
+			props: map[string]string{
+				"ro.product.cpu.abilist": "arm64-v8a,armeabi-v7a,armeabi",
+				"ro.product.cpu.abi":     "arm64-v8a",
+				"ro.sf.lcd_density":      "440",
+				"ro.build.version.sdk":   "30",
+				"persist.sys.locale":     "fr-FR",
+				"ro.product.locale":      "en-US",
+			},
+			want: DeviceSpec{ABIs: []string{"arm64-v8a", "armeabi-v7a", "armeabi"}, Density: 440, Locales: []string{"fr-FR", "en-US"}, APILevel: 30},
+		},
+		{
+			name: "legacy",
+			props: map[string]string{
+				"ro.product.cpu.abi":         "armeabi-v7a",
+				"ro.product.cpu.abi2":        "armeabi",
+				"ro.product.locale.language": "de",
+			},
+			want: DeviceSpec{ABIs: []string{"armeabi-v7a", "armeabi"}, Locales: []string{"de"}},
+		},
+		{
+			name: "unknown",
+			want: DeviceSpec{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := DeviceSpecFromProps(tc.props)
+			if !equalStrings(got.ABIs, tc.want.ABIs) || got.Density != tc.want.Density || !equalStrings(got.Locales, tc.want.Locales) || got.APILevel != tc.want.APILevel {
+				t.Errorf("Got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
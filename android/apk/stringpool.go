@@ -0,0 +1,151 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+)
+
+const (
+	resStringPoolUTF8 = 0x100
+
+	resStringPoolSpanEnd = 0xffffffff
+)
+
+// stringSpan is the style of a range of a string, e.g. tag `b`, in UTF-16 code units.
+type stringSpan struct {
+	tag         string
+	first, last uint32
+}
+
+// stringPool is a ResStringPool, as used by binary XML and resources.arsc.
+type stringPool struct {
+	strings []string
+	// Of the first len(styles) strings
+	styles [][]stringSpan
+	index  map[string]uint32
+}
+
+func newStringPool() *stringPool {
+	return &stringPool{index: make(map[string]uint32)}
+}
+
+// add returns the index of s, adding it if it's not already pooled.
+func (p *stringPool) add(s string) uint32 {
+	if i, ok := p.index[s]; ok {
+		return i
+	}
+	p.index[s] = p.addUnique(s)
+	return p.index[s]
+}
+
+// addUnique adds s at a new index, which isn't shared by others adding it.
+func (p *stringPool) addUnique(s string) uint32 {
+	p.strings = append(p.strings, s)
+	return uint32(len(p.strings) - 1)
+}
+
+// addStyled adds s with its spans, which must be before any unstyled strings are added.
+func (p *stringPool) addStyled(s string, spans []stringSpan) uint32 {
+	if len(p.styles) != len(p.strings) {
+		panic("styled strings must be pooled first")
+	}
+	p.styles = append(p.styles, spans)
+	return p.addUnique(s)
+}
+
+// poolLength is the length prefix of a string, in one or two units of unit bits.
+func poolLength(buf *bytes.Buffer, n int, unit uint) error {
+	high := 1 << (unit - 1)
+	if n >= high*(1<<unit) {
+		return fmt.Errorf("String of length %d is too long for a string pool", n)
+	}
+
+	var units []int
+	if n >= high {
+		units = []int{high | n>>unit, n & (1<<unit - 1)}
+	} else {
+		units = []int{n}
+	}
+
+	for _, u := range units {
+		if unit == 8 {
+			buf.WriteByte(byte(u))
+		} else {
+			binary.Write(buf, binary.LittleEndian, uint16(u))
+		}
+	}
+	return nil
+}
+
+func (p *stringPool) encode(utf8 bool) ([]byte, error) {
+	var data bytes.Buffer
+	offsets := make([]uint32, len(p.strings))
+	for i, s := range p.strings {
+		offsets[i] = uint32(data.Len())
+		chars := utf16.Encode([]rune(s))
+
+		if utf8 {
+			if err := poolLength(&data, len(chars), 8); err != nil {
+				return nil, err
+			}
+			if err := poolLength(&data, len(s), 8); err != nil {
+				return nil, err
+			}
+			data.WriteString(s)
+			data.WriteByte(0)
+		} else {
+			if err := poolLength(&data, len(chars), 16); err != nil {
+				return nil, err
+			}
+			binary.Write(&data, binary.LittleEndian, chars)
+			binary.Write(&data, binary.LittleEndian, uint16(0))
+		}
+	}
+	for data.Len()%4 != 0 {
+		data.WriteByte(0)
+	}
+
+	var styles bytes.Buffer
+	styleOffsets := make([]uint32, len(p.styles))
+	for i, spans := range p.styles {
+		styleOffsets[i] = uint32(styles.Len())
+		for _, span := range spans {
+			binary.Write(&styles, binary.LittleEndian, []uint32{p.index[span.tag], span.first, span.last})
+		}
+		binary.Write(&styles, binary.LittleEndian, uint32(resStringPoolSpanEnd))
+	}
+	if len(p.styles) > 0 {
+		// The platform expects a whole span's worth of ends to finish the styles
+		binary.Write(&styles, binary.LittleEndian, []uint32{resStringPoolSpanEnd, resStringPoolSpanEnd})
+	}
+
+	const headerSize = 28
+	stringsStart := headerSize + 4*len(p.strings) + 4*len(p.styles)
+	var stylesStart int
+	if len(p.styles) > 0 {
+		stylesStart = stringsStart + data.Len()
+	}
+
+	var flags uint32
+	if utf8 {
+		flags = resStringPoolUTF8
+	}
+
+	var chunk bytes.Buffer
+	binary.Write(&chunk, binary.LittleEndian, []uint16{resStringPoolType, headerSize})
+	binary.Write(&chunk, binary.LittleEndian, []uint32{
+		uint32(stringsStart + data.Len() + styles.Len()),
+		uint32(len(p.strings)),
+		uint32(len(p.styles)),
+		flags,
+		uint32(stringsStart),
+		uint32(stylesStart),
+	})
+	binary.Write(&chunk, binary.LittleEndian, offsets)
+	binary.Write(&chunk, binary.LittleEndian, styleOffsets)
+	chunk.Write(data.Bytes())
+	chunk.Write(styles.Bytes())
+	return chunk.Bytes(), nil
+}
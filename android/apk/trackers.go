@@ -0,0 +1,206 @@
+package repo
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	_ "embed"
+)
+
+// A subset of the Exodus Privacy tracker signatures, https://reports.exodus-privacy.eu.org/en/trackers/
+//
+//go:embed trackers.json
+var bundledTrackers []byte
+
+type tracker struct {
+	Name          string `json:"name"`
+	CodeSignature string `json:"code_signature"`
+}
+
+// TrackerDB recognises trackers by the names of the classes in their SDKs.
+type TrackerDB struct {
+	names      []string
+	signatures []*regexp.Regexp
+}
+
+// ParseTrackerDB reads signatures in the format of the Exodus Privacy API's `/api/trackers`.
+func ParseTrackerDB(data []byte) (*TrackerDB, error) {
+	var exodus struct {
+		Trackers map[string]tracker `json:"trackers"`
+	}
+	if err := json.Unmarshal(data, &exodus); err != nil {
+		return nil, fmt.Errorf("Failed to parse tracker signatures: %s", err)
+	}
+
+	var trackers []tracker
+	for _, t := range exodus.Trackers {
+		if t.CodeSignature != "" {
+			trackers = append(trackers, t)
+		}
+	}
+	sort.Slice(trackers, func(i, j int) bool {
+		return trackers[i].Name < trackers[j].Name
+	})
+
+	db := &TrackerDB{}
+	for _, t := range trackers {
+		re, err := regexp.Compile(t.CodeSignature)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid signature for tracker %s: %s", t.Name, err)
+		}
+
+		db.names = append(db.names, t.Name)
+		db.signatures = append(db.signatures, re)
+	}
+
+	return db, nil
+}
+
+// LoadTrackerDB reads signatures from path, or the bundled ones if path is empty.
+func LoadTrackerDB(path string) (*TrackerDB, error) {
+	if path == "" {
+		return ParseTrackerDB(bundledTrackers)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseTrackerDB(data)
+}
+
+func uleb128(data []byte) (uint32, int) {
+	var v uint32
+	for i := 0; i < len(data) && i < 5; i++ {
+		v |= uint32(data[i]&0x7f) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v, len(data)
+}
+
+// dexClassNames lists the classes defined in a dex file, e.g. `com.example.Foo`.
+func dexClassNames(dex []byte) ([]string, error) {
+	if len(dex) < 0x70 || !strings.HasPrefix(string(dex), "dex\n") {
+		return nil, fmt.Errorf("not a dex file")
+	}
+
+	u32 := func(off uint32) (uint32, error) {
+		if uint64(off)+4 > uint64(len(dex)) {
+			return 0, fmt.Errorf("truncated dex file")
+		}
+		return binary.LittleEndian.Uint32(dex[off:]), nil
+	}
+
+	stringIdsSize, stringIdsOff := binary.LittleEndian.Uint32(dex[0x38:]), binary.LittleEndian.Uint32(dex[0x3c:])
+	typeIdsSize, typeIdsOff := binary.LittleEndian.Uint32(dex[0x40:]), binary.LittleEndian.Uint32(dex[0x44:])
+	classDefsSize, classDefsOff := binary.LittleEndian.Uint32(dex[0x60:]), binary.LittleEndian.Uint32(dex[0x64:])
+
+	var names []string
+	for i := uint32(0); i < classDefsSize; i++ {
+		typeIdx, err := u32(classDefsOff + 32*i)
+		if err != nil {
+			return nil, err
+		}
+		if typeIdx >= typeIdsSize {
+			return nil, fmt.Errorf("invalid type index")
+		}
+
+		stringIdx, err := u32(typeIdsOff + 4*typeIdx)
+		if err != nil {
+			return nil, err
+		}
+		if stringIdx >= stringIdsSize {
+			return nil, fmt.Errorf("invalid string index")
+		}
+
+		stringOff, err := u32(stringIdsOff + 4*stringIdx)
+		if err != nil {
+			return nil, err
+		}
+		if stringOff >= uint32(len(dex)) {
+			return nil, fmt.Errorf("truncated dex file")
+		}
+
+		// MUTF-8, but a class descriptor's only ASCII in practice, as far as trackers are concerned
+		_, n := uleb128(dex[stringOff:])
+		data := dex[int(stringOff)+n:]
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated string")
+		}
+
+		descriptor := string(data[:end])
+		if strings.HasPrefix(descriptor, "L") && strings.HasSuffix(descriptor, ";") {
+			names = append(names, strings.ReplaceAll(descriptor[1:len(descriptor)-1], "/", "."))
+		}
+	}
+
+	return names, nil
+}
+
+// DetectTrackers scans the dex files of the APKs that apk acquired, returning the names of the
+// trackers in db whose signatures match any class.
+func DetectTrackers(apk APKAcquirer, db *TrackerDB) ([]string, error) {
+	found := make([]bool, len(db.names))
+
+	for _, apkPath := range apk.Apk().Paths {
+		zr, err := zip.OpenReader(apkPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range zr.File {
+			if strings.Contains(f.Name, "/") || path.Ext(f.Name) != ".dex" {
+				continue
+			}
+
+			dex, err := readZipFile(f)
+			if err != nil {
+				zr.Close()
+				return nil, err
+			}
+
+			classes, err := dexClassNames(dex)
+			if err != nil {
+				zr.Close()
+				return nil, fmt.Errorf("Failed to read %s in %s: %s", f.Name, apkPath, err)
+			}
+
+			for i, re := range db.signatures {
+				if found[i] {
+					continue
+				}
+
+				for _, class := range classes {
+					if re.MatchString(class) {
+						found[i] = true
+						break
+					}
+				}
+			}
+		}
+		zr.Close()
+	}
+
+	var trackers []string
+	for i, ok := range found {
+		if ok {
+			trackers = append(trackers, db.names[i])
+		}
+	}
+
+	log.Printf("[INFO] Found %d trackers in %s: %v", len(trackers), apk.Apk().Name, trackers)
+	return trackers, nil
+}
@@ -0,0 +1,134 @@
+package repo
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"mvdan.cc/fdroidcl/adb"
+)
+
+type URLPackage struct {
+	apk     *Apk
+	url     string
+	sha256  string
+	signing *SigningKey
+}
+
+func init() {
+	RegisterMethod("url", func(apk *Apk, opts Options) APKAcquirer {
+		return URLPackage{apk, opts.URL, opts.Sha256, opts.BundleSigningKey}
+	})
+}
+
+func (pkg URLPackage) Apk() *Apk {
+	return pkg.apk
+}
+
+func (pkg URLPackage) GetApkPaths(device *adb.Device, _ *int) ([]string, error) {
+	if pkg.Apk().Paths == nil {
+		if err := pkg.UpdateCache(device); err != nil {
+			return nil, err
+		}
+	}
+
+	return pkg.Apk().Paths, nil
+}
+
+func (pkg URLPackage) UpdateCache(device *adb.Device) error {
+	if pkg.url == "" {
+		return fmt.Errorf("url required for %s", pkg.apk.Name)
+	}
+
+	sum, err := hex.DecodeString(strings.ToLower(pkg.sha256))
+	if err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("sha256 of %s must be %d hex-encoded bytes, got: %q", pkg.apk.Name, sha256.Size, pkg.sha256)
+	}
+
+	source := fmt.Sprintf("url:%x", sum)
+	paths, ok, err := cachedBySource(source)
+	if err != nil {
+		return err
+	}
+
+	if !ok && device != nil && pkg.signing != nil {
+		// An App Bundle's APKs are cached for each device they're built for, by its checksum
+		if paths, ok, err = cachedBundleApks(sum, device, pkg.signing); err != nil {
+			return err
+		}
+	}
+
+	if !ok && pkg.apk.Offline {
+		return errNotCached(fmt.Sprintf("%s from %s", pkg.apk.Name, pkg.url))
+	}
+
+	if !ok {
+		if paths, err = pkg.download(device, sum, source); err != nil {
+			return err
+		}
+	}
+
+	basePath, err := findBaseApk(paths)
+	if err != nil {
+		return err
+	}
+
+	pkg.apk.BasePath = &basePath
+	pkg.apk.Paths = paths
+	return nil
+}
+
+func (pkg URLPackage) download(device *adb.Device, sum []byte, source string) ([]string, error) {
+	stagingDir, err := cacheStagingDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	// Named .apk since `adb install` requires it, even though it may be a zip of splits
+	dlPath := fmt.Sprintf("%s/%x.apk", stagingDir, sum)
+	log.Printf("[INFO] Downloading %s from %s", pkg.apk.Name, pkg.url)
+	if err = downloadEtag(pkg.url, dlPath, sum, pkg.apk.Offline); err != nil {
+		return nil, fmt.Errorf("Failed to download %s: %s", pkg.apk.Name, err)
+	}
+
+	isApk, err := zipHasFile(dlPath, "AndroidManifest.xml")
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither an APK, App Bundle, nor a zip of APKs: %s", pkg.url, err)
+	}
+
+	var paths []string
+	if isApk {
+		paths = []string{dlPath}
+	} else if isAppBundle(dlPath) {
+		// Cached by the bundle's checksum, for the device
+		return buildBundleApks(dlPath, device, pkg.signing, pkg.apk.evictionLimits())
+	} else {
+		splitsDir := fmt.Sprintf("%s/%x", stagingDir, sum)
+		if paths, err = unpackBundle(dlPath, splitsDir); err != nil {
+			return nil, err
+		}
+	}
+
+	return cacheStore(paths, source, pkg.apk.evictionLimits())
+}
+
+func zipHasFile(path string, name string) (bool, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return false, err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.Name == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,144 @@
+package repo
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testArchive is a zip of files, by name.
+func testArchive(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestURLPackage(t *testing.T) {
+	apks := testSplitApks(t, testSigningKey(t))
+
+	splits := make(map[string][]byte)
+	for name, data := range apks {
+		splits[name+".apk"] = data
+	}
+	zipped := testArchive(t, splits)
+
+	hexSum := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return fmt.Sprintf("%x", sum)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		served  []byte
+		status  int
+		sha256  string
+		offline bool
+		apks    int
+		err     string
+	}{
+		{name: "apk", served: apks["base"], sha256: hexSum(apks["base"]), apks: 1},
+		{name: "uppercase sha256", served: apks["base"], sha256: strings.ToUpper(hexSum(apks["base"])), apks: 1},
+		{name: "zip of splits", served: zipped, sha256: hexSum(zipped), apks: len(apks)},
+		{name: "sha256 mismatch", served: apks["base"], sha256: hexSum(zipped), err: "Failed to download org.example.app: sha256 mismatch"},
+		{name: "invalid sha256", served: apks["base"], sha256: "abc", err: `sha256 of org.example.app must be 32 hex-encoded bytes, got: "abc"`},
+		{name: "not found", status: http.StatusNotFound, sha256: hexSum(apks["base"]), err: "Failed to download org.example.app: download failed: 404 Not Found"},
+		{name: "offline", served: apks["base"], sha256: hexSum(apks["base"]), offline: true, err: "org.example.app from "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestCache(t)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.status != 0 {
+					w.WriteHeader(tc.status)
+					return
+				}
+				w.Write(tc.served)
+			}))
+			defer srv.Close()
+
+			apk := &Apk{Name: "org.example.app", Offline: tc.offline}
+			err := URLPackage{apk, srv.URL + "/app.apk", tc.sha256, nil}.UpdateCache(nil)
+
+			if tc.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+					t.Fatalf("Got error %v, want %s", err, tc.err)
+				}
+				if paths, ok, _ := cachedNewest("org.example.app", nil); ok {
+					t.Errorf("Cached %v, despite failing", paths)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(apk.Paths) != tc.apks || *apk.BasePath != apk.Paths[0] {
+				t.Fatalf("Got %v, want %d APKs, base first", apk.Paths, tc.apks)
+			}
+			dir, err := apkCacheDir()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range apk.Paths {
+				if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+					t.Errorf("%s isn't in the cache", path)
+				}
+			}
+		})
+	}
+}
+
+func TestURLPackageBundleCached(t *testing.T) {
+	useTestCache(t)
+	device := useTestAdb(t, `echo "unexpected: $*" >&2; exit 1`)
+
+	bundle := testBundleData(t)
+	sum := sha256.Sum256(bundle)
+
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write(bundle)
+	}))
+	defer srv.Close()
+
+	key := testSigningKey(t)
+	var built []string
+	for i, offline := range []bool{false, false, true} {
+		apk := &Apk{Name: "org.example.app", Offline: offline}
+		if err := (URLPackage{apk, srv.URL + "/app.aab", fmt.Sprintf("%x", sum), key}).UpdateCache(device); err != nil {
+			t.Fatalf("UpdateCache %d: %s", i, err)
+		}
+
+		if built == nil {
+			built = apk.Paths
+		} else if !equalStrings(apk.Paths, built) {
+			t.Errorf("UpdateCache %d got %v, want %v from the cache", i, apk.Paths, built)
+		}
+	}
+
+	if len(built) != 4 {
+		t.Errorf("Built %v, want a master APK and ABI, density, and language splits", built)
+	}
+	if downloads != 1 {
+		t.Errorf("Downloaded the bundle %d times, want once", downloads)
+	}
+}
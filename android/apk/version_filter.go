@@ -0,0 +1,153 @@
+package repo
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type versionBound struct {
+	op          string
+	versionCode int
+}
+
+func (b versionBound) allows(versionCode int) bool {
+	switch b.op {
+	case "=", "==":
+		return versionCode == b.versionCode
+	case "!=":
+		return versionCode != b.versionCode
+	case ">":
+		return versionCode > b.versionCode
+	case ">=":
+		return versionCode >= b.versionCode
+	case "<":
+		return versionCode < b.versionCode
+	case "<=":
+		return versionCode <= b.versionCode
+	}
+	return false
+}
+
+// VersionFilter restricts which builds an APKAcquirer may pick, by versionCode and versionName.
+// A nil *VersionFilter allows everything.
+type VersionFilter struct {
+	constraint  string
+	bounds      []versionBound
+	namePattern *regexp.Regexp
+}
+
+var versionBoundRe = regexp.MustCompile(`^(==|=|!=|>=|<=|>|<)?\s*([0-9]+)$`)
+
+// ParseVersionFilter parses a comma-separated versionCode constraint, e.g. `>= 4100, < 4200`,
+// and a regular expression that the versionName must match. Either may be empty.
+func ParseVersionFilter(constraint string, namePattern string) (*VersionFilter, error) {
+	if constraint == "" && namePattern == "" {
+		return nil, nil
+	}
+
+	filter := VersionFilter{constraint: constraint}
+
+	if constraint != "" {
+		for _, part := range strings.Split(constraint, ",") {
+			m := versionBoundRe.FindStringSubmatch(strings.TrimSpace(part))
+			if m == nil {
+				return nil, fmt.Errorf("Invalid version constraint %q: expected e.g. `>= 4100, < 4200`", part)
+			}
+
+			op := m[1]
+			if op == "" {
+				op = "="
+			}
+
+			versionCode, err := strconv.Atoi(m[2])
+			if err != nil {
+				return nil, err
+			}
+
+			filter.bounds = append(filter.bounds, versionBound{op, versionCode})
+		}
+	}
+
+	if namePattern != "" {
+		re, err := regexp.Compile(namePattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid version name pattern %q: %s", namePattern, err)
+		}
+		filter.namePattern = re
+	}
+
+	return &filter, nil
+}
+
+// WithVersionCode returns a copy of f that additionally requires exactly versionCode.
+func (f *VersionFilter) WithVersionCode(versionCode int) *VersionFilter {
+	filter := VersionFilter{}
+	if f != nil {
+		filter = *f
+	}
+
+	filter.bounds = append(append([]versionBound{}, filter.bounds...), versionBound{"=", versionCode})
+	if filter.constraint == "" {
+		filter.constraint = fmt.Sprintf("= %d", versionCode)
+	} else {
+		filter.constraint = fmt.Sprintf("%s, = %d", filter.constraint, versionCode)
+	}
+
+	return &filter
+}
+
+func (f *VersionFilter) Allows(versionCode int, versionName string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, b := range f.bounds {
+		if !b.allows(versionCode) {
+			return false
+		}
+	}
+
+	return f.namePattern == nil || f.namePattern.MatchString(versionName)
+}
+
+func (f *VersionFilter) String() string {
+	if f == nil {
+		return "any version"
+	}
+
+	var parts []string
+	if f.constraint != "" {
+		parts = append(parts, fmt.Sprintf("versionCode %s", f.constraint))
+	}
+	if f.namePattern != nil {
+		parts = append(parts, fmt.Sprintf("versionName =~ /%s/", f.namePattern))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// CheckVersion fails if the APK that apk acquired isn't allowed by its VersionFilter, which
+// acquirers with a choice of versions use to pick, but others can only be checked against.
+func CheckVersion(apk APKAcquirer) error {
+	filter := apk.Apk().VersionFilter
+	if filter == nil {
+		return nil
+	}
+
+	v, err := Version(apk)
+	if err != nil {
+		return err
+	}
+
+	vn, err := VersionName(apk)
+	if err != nil {
+		return err
+	}
+
+	if !filter.Allows(v, vn) {
+		return fmt.Errorf("%s %s (%d) does not satisfy %s", apk.Apk().Name, vn, v, filter)
+	}
+
+	return nil
+}
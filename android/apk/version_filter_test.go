@@ -0,0 +1,169 @@
+package repo
+
+import (
+	"fmt"
+	"testing"
+
+	"mvdan.cc/fdroidcl/fdroid"
+)
+
+func TestVersionFilter(t *testing.T) {
+	for _, tc := range []struct {
+		constraint  string
+		namePattern string
+		versionCode int
+		versionName string
+		allows      bool
+		str         string
+		err         string
+	}{
+		{versionCode: 42, allows: true, str: "any version"},
+		{constraint: ">= 4100, < 4200", versionCode: 4100, allows: true, str: "versionCode >= 4100, < 4200"},
+		{constraint: ">= 4100, < 4200", versionCode: 4200},
+		{constraint: ">=4100,<4200", versionCode: 4199, allows: true},
+		{constraint: "42", versionCode: 42, allows: true},
+		{constraint: "== 42", versionCode: 43},
+		{constraint: "!= 42", versionCode: 43, allows: true},
+		{constraint: "<= 42", versionCode: 42, allows: true},
+		{constraint: "> 42", versionCode: 42},
+		{namePattern: `^4\.2(\.[0-9]+)?$`, versionName: "4.2.1", allows: true, str: `versionName =~ /^4\.2(\.[0-9]+)?$/`},
+		{namePattern: `^4\.2(\.[0-9]+)?$`, versionName: "4.2-beta"},
+		{constraint: "< 50", namePattern: "beta", versionCode: 42, versionName: "4.2", str: "versionCode < 50 and versionName =~ /beta/"},
+		{constraint: "~> 4.2", err: "Invalid version constraint \"~> 4.2\": expected e.g. `>= 4100, < 4200`"},
+		{constraint: ">= 1,", err: "Invalid version constraint \"\": expected e.g. `>= 4100, < 4200`"},
+		{namePattern: "(", err: "Invalid version name pattern \"(\": error parsing regexp: missing closing ): `(`"},
+	} {
+		t.Run(fmt.Sprintf("%s %s", tc.constraint, tc.namePattern), func(t *testing.T) {
+			filter, err := ParseVersionFilter(tc.constraint, tc.namePattern)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("Got error %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := filter.Allows(tc.versionCode, tc.versionName); got != tc.allows {
+				t.Errorf("Allows(%d, %q) = %t, want %t", tc.versionCode, tc.versionName, got, tc.allows)
+			}
+			if tc.str != "" && filter.String() != tc.str {
+				t.Errorf("Got %q, want %q", filter.String(), tc.str)
+			}
+		})
+	}
+}
+
+func TestVersionFilterWithVersionCode(t *testing.T) {
+	filter, err := ParseVersionFilter(">= 40", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := filter.WithVersionCode(42)
+	if !pinned.Allows(42, "") || pinned.Allows(43, "") || !filter.Allows(43, "") {
+		t.Errorf("%s doesn't pin only the copy to 42", pinned)
+	}
+	if got := (*VersionFilter)(nil).WithVersionCode(42).String(); got != "versionCode = 42" {
+		t.Errorf("Got %q, want versionCode = 42", got)
+	}
+}
+
+func TestFDroidSelectApk(t *testing.T) {
+	apks := []fdroid.Apk{
+		{VersCode: 44, VersName: "4.4-beta"},
+		{VersCode: 43, VersName: "4.3"},
+		{VersCode: 42, VersName: "4.2", ABIs: []string{"x86_64"}},
+		{VersCode: 41, VersName: "4.1"},
+	}
+	app := fdroid.App{PackageName: "org.example.app", SugVersCode: 43}
+	for i := range apks {
+		app.Apks = append(app.Apks, &apks[i])
+	}
+
+	for _, tc := range []struct {
+		constraint  string
+		namePattern string
+		versionCode int
+		want        int
+	}{
+		{want: 43},
+		{constraint: "< 43", want: 41},
+		{constraint: ">= 44", want: 44},
+		{namePattern: "beta", want: 44},
+		{versionCode: 41, want: 41},
+		{constraint: "> 44"},
+		{versionCode: 42},
+	} {
+		t.Run(fmt.Sprintf("%s %s %d", tc.constraint, tc.namePattern, tc.versionCode), func(t *testing.T) {
+			filter, err := ParseVersionFilter(tc.constraint, tc.namePattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pkg := FDroidPackage{apk: &Apk{Name: app.PackageName, VersionFilter: filter}, versionCode: tc.versionCode}
+			got := pkg.selectApk(app, testFDroidDevice)
+			if got == nil && tc.want != 0 || got != nil && got.VersCode != tc.want {
+				t.Errorf("Selected %v, want versionCode %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	path := writeTestApks(t, t.TempDir(), testSplitApks(t, testSigningKey(t)))["base"]
+
+	for _, tc := range []struct {
+		constraint string
+		err        string
+	}{
+		{constraint: ""},
+		{constraint: ">= 42"},
+		{constraint: "> 42", err: "org.example.app  (42) does not satisfy versionCode > 42"},
+	} {
+		filter, err := ParseVersionFilter(tc.constraint, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pkg, err := Package([]string{"local"}, "org.example.app", Options{Path: path, VersionFilter: filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = pkg.GetApkPaths(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		err = CheckVersion(pkg)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%s: got error %v, want %q", tc.constraint, err, tc.err)
+		}
+	}
+}
+
+func TestFDroidVersionFilterUnsatisfied(t *testing.T) {
+	useTestCache(t)
+	key := testSigningKey(t)
+
+	repo := newFDroidTestRepo(t, make(map[string][]byte))
+	repo.files["index-v1.jar"] = testFDroidIndexV1(t, key, repo.url(), []byte("42"))
+
+	filter, err := ParseVersionFilter("> 42", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkg, err := Package([]string{"fdroid"}, "org.example.app", Options{
+		FDroidRepos:   []FDroidRepo{{URL: repo.url(), Fingerprint: certFingerprint(key.Cert)}},
+		VersionFilter: filter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[INFO] No org.example.app app found satisfying versionCode > 42"
+	if err = pkg.UpdateCache(testFDroidDevice); err == nil || err.Error() != want {
+		t.Errorf("Got error %v, want %s", err, want)
+	}
+}
@@ -1,13 +1,172 @@
 package android
 
 import (
+	"time"
+
+	"github.com/OJFord/terraform-provider-android/android/apk"
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
 	"mvdan.cc/fdroidcl/adb"
 )
 
+func fdroidRepoSchema(description string) *schema.Schema {
+	return &schema.Schema{
+		Description: description,
+		Optional:    true,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"fingerprint": {
+					Description: "SHA-256 fingerprint of the repo's signing certificate, which its index must be signed with.",
+					Required:    true,
+					Type:        schema.TypeString,
+				},
+				"password": {
+					Description: "Password for HTTP basic auth.",
+					Optional:    true,
+					Sensitive:   true,
+					Type:        schema.TypeString,
+				},
+				"url": {
+					Description: "Address of the repo, e.g. `https://f-droid.org/repo`",
+					Required:    true,
+					Type:        schema.TypeString,
+				},
+				"username": {
+					Description: "Username for HTTP basic auth.",
+					Optional:    true,
+					Type:        schema.TypeString,
+				},
+			},
+		},
+		Type: schema.TypeList,
+	}
+}
+
+func expandFDroidRepos(v interface{}) []repo.FDroidRepo {
+	var repos []repo.FDroidRepo
+	for _, r := range v.([]interface{}) {
+		r := r.(map[string]interface{})
+		repos = append(repos, repo.FDroidRepo{
+			URL:         r["url"].(string),
+			Fingerprint: r["fingerprint"].(string),
+			Username:    r["username"].(string),
+			Password:    r["password"].(string),
+		})
+	}
+	return repos
+}
+
+func permissionsSchema(description string) *schema.Schema {
+	return &schema.Schema{
+		Description: description,
+		Elem: &schema.Schema{
+			Type: schema.TypeString,
+		},
+		Optional: true,
+		Type:     schema.TypeList,
+	}
+}
+
+func expandPermissionPolicy(d resourceGetter) repo.PermissionPolicy {
+	var policy repo.PermissionPolicy
+	for _, perm := range d.Get("allowed_permissions").([]interface{}) {
+		policy.Allowed = append(policy.Allowed, perm.(string))
+	}
+	for _, perm := range d.Get("denied_permissions").([]interface{}) {
+		policy.Denied = append(policy.Denied, perm.(string))
+	}
+	return policy
+}
+
 func Provider() *schema.Provider {
 	return &schema.Provider{
-		Schema: map[string]*schema.Schema{},
+		Schema: map[string]*schema.Schema{
+			"allowed_permissions": permissionsSchema("If set, the only permissions any `android_apk` may request, e.g. `INTERNET` or `android.permission.INTERNET`. Checked at plan time, so an update requesting another fails the plan."),
+			"aurora_download_timeout": {
+				Default:     30,
+				Description: "Minutes to wait for AuroraStore to download an `android_apk`, after which it fails; 0 to wait indefinitely. AuroraStore doesn't report failed downloads, so they fail only once this passes.",
+				Optional:    true,
+				Type:        schema.TypeInt,
+			},
+			"aurora_start_timeout": {
+				Default:     60,
+				Description: "Seconds to wait for AuroraStore to start downloading an `android_apk`, as shown by the markers it leaves in its download directory, after which it's requested again (and again each time this passes without it starting); 0 to wait indefinitely.",
+				Optional:    true,
+				Type:        schema.TypeInt,
+			},
+			"bundle_signing_certificate": {
+				Description:  "Path to the PEM-encoded certificate of `bundle_signing_key`.",
+				Optional:     true,
+				RequiredWith: []string{"bundle_signing_key"},
+				Type:         schema.TypeString,
+			},
+			"bundle_signing_key": {
+				Description:  "Path to a PEM-encoded RSA or EC private key, to sign the APKs built from Android App Bundles (`.aab`) with. Devices only accept updates signed by the same key as the installed app.",
+				Optional:     true,
+				RequiredWith: []string{"bundle_signing_certificate"},
+				Type:         schema.TypeString,
+			},
+			"cache_max_age": {
+				Default:     90,
+				Description: "Days after which APKs that haven't been used are evicted from the cache; 0 to keep them indefinitely.",
+				Optional:    true,
+				Type:        schema.TypeInt,
+			},
+			"cache_max_size": {
+				Default:     4096,
+				Description: "Size in MiB beyond which the least recently used APKs are evicted from the cache; 0 for no limit. APKs used by the current run, or within the last day (e.g. by a concurrent one), are never evicted.",
+				Optional:    true,
+				Type:        schema.TypeInt,
+			},
+			"denied_permissions": permissionsSchema("Permissions no `android_apk` may request, e.g. `READ_SMS` or `android.permission.ACCESS_BACKGROUND_LOCATION`. Checked at plan time, so an update requesting one fails the plan."),
+			"exec_timeout": {
+				Default:     10,
+				Description: "Minutes to wait for the `command` of an `android_apk` with the `exec` method, after which it's killed and fails; 0 to wait indefinitely.",
+				Optional:    true,
+				Type:        schema.TypeInt,
+			},
+			"fdroid_preparsed_index": {
+				Default:     false,
+				Description: "Whether to also cache F-Droid indices in a pre-parsed form that's quicker to load, while the repo hasn't changed. Either way, each repo's index is loaded at most once per run.",
+				Optional:    true,
+				Type:        schema.TypeBool,
+			},
+			"fdroid_repo": fdroidRepoSchema("F-Droid repositories to search, in order, for `android_apk`s with the `fdroid` method. Defaults to just `https://f-droid.org/repo`."),
+			"gplay_device_profile": {
+				Description: "Path to a device profile to download from Google Play as, in the `.properties` format of gplaycli and AuroraStore. Defaults to the properties of the device being installed to.",
+				Optional:    true,
+				Type:        schema.TypeString,
+			},
+			"gplay_gsf_id": {
+				DefaultFunc: schema.EnvDefaultFunc("ANDROID_GPLAY_GSF_ID", ""),
+				Description: "Google Services Framework ID, in hex, of a device checked in to Google Play with the account of `gplay_token`, for the `gplaycli` method. Can also be set with the `ANDROID_GPLAY_GSF_ID` environment variable.",
+				Optional:    true,
+				Type:        schema.TypeString,
+			},
+			"gplay_token": {
+				DefaultFunc: schema.EnvDefaultFunc("ANDROID_GPLAY_TOKEN", ""),
+				Description: "Auth token of the Google account to download from Google Play with, for the `gplaycli` method. Can also be set with the `ANDROID_GPLAY_TOKEN` environment variable.",
+				Optional:    true,
+				Sensitive:   true,
+				Type:        schema.TypeString,
+			},
+			"offline": {
+				DefaultFunc: schema.EnvDefaultFunc("ANDROID_OFFLINE", false),
+				Description: "Acquire APKs only from the cache, without network access or AuroraStore, failing for any that aren't cached. F-Droid versions are chosen from the index as last downloaded; other methods that can't tell what's available use the newest cached version. Can also be set with the `ANDROID_OFFLINE` environment variable.",
+				Optional:    true,
+				Type:        schema.TypeBool,
+			},
+			"refresh_interval": {
+				Default:     0,
+				Description: "Minutes after checking the source of an `android_apk` for updates within which it isn't checked again, reusing what was found then from the cache; 0 to always check. Applies to the `aurora`, `device`, `fdroid`, and `gplaycli` methods.",
+				Optional:    true,
+				Type:        schema.TypeInt,
+			},
+			"tracker_signatures": {
+				Description: "Path to tracker signatures to detect `android_apk`s' `trackers` with, in the format of the [Exodus Privacy](https://reports.exodus-privacy.eu.org/) API's `/api/trackers`. Defaults to a bundled subset of them.",
+				Optional:    true,
+				Type:        schema.TypeString,
+			},
+		},
 		ResourcesMap: map[string]*schema.Resource{
 			"android_apk": resourceAndroidApk(),
 		},
@@ -23,7 +182,18 @@ type Device struct {
 }
 
 type Meta struct {
-	devices map[string]Device
+	devices          map[string]Device
+	fdroidRepos      []repo.FDroidRepo
+	fdroidIndices    *repo.FDroidIndices
+	bundleSigningKey *repo.SigningKey
+	gplay            *repo.GPlayConfig
+	permissionPolicy repo.PermissionPolicy
+	trackerDB        *repo.TrackerDB
+	offline          bool
+	cacheLimits      repo.CacheLimits
+	refreshInterval  time.Duration
+	execTimeout      time.Duration
+	auroraTimeouts   repo.AuroraTimeouts
 }
 
 func providerConfigure(d *schema.ResourceData) (interface{}, error) {
@@ -33,7 +203,48 @@ func providerConfigure(d *schema.ResourceData) (interface{}, error) {
 		}
 	}
 
+	var bundleSigningKey *repo.SigningKey
+	if keyPath := d.Get("bundle_signing_key").(string); keyPath != "" {
+		var err error
+		if bundleSigningKey, err = repo.LoadSigningKey(keyPath, d.Get("bundle_signing_certificate").(string)); err != nil {
+			return nil, err
+		}
+	}
+
+	gplay := &repo.GPlayConfig{
+		Token: d.Get("gplay_token").(string),
+		GSFID: d.Get("gplay_gsf_id").(string),
+	}
+	if profilePath := d.Get("gplay_device_profile").(string); profilePath != "" {
+		var err error
+		if gplay.DeviceProfile, err = repo.LoadGPlayDeviceProfile(profilePath); err != nil {
+			return nil, err
+		}
+	}
+
+	trackerDB, err := repo.LoadTrackerDB(d.Get("tracker_signatures").(string))
+	if err != nil {
+		return nil, err
+	}
+
 	return Meta{
 		make(map[string]Device),
+		expandFDroidRepos(d.Get("fdroid_repo")),
+		repo.NewFDroidIndices(d.Get("fdroid_preparsed_index").(bool)),
+		bundleSigningKey,
+		gplay,
+		expandPermissionPolicy(d),
+		trackerDB,
+		d.Get("offline").(bool),
+		repo.CacheLimits{
+			MaxSize: int64(d.Get("cache_max_size").(int)) << 20,
+			MaxAge:  time.Duration(d.Get("cache_max_age").(int)) * 24 * time.Hour,
+		},
+		time.Duration(d.Get("refresh_interval").(int)) * time.Minute,
+		time.Duration(d.Get("exec_timeout").(int)) * time.Minute,
+		repo.AuroraTimeouts{
+			Start:    time.Duration(d.Get("aurora_start_timeout").(int)) * time.Second,
+			Download: time.Duration(d.Get("aurora_download_timeout").(int)) * time.Minute,
+		},
 	}, nil
 }
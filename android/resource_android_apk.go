@@ -8,6 +8,7 @@ import (
 
 	"github.com/OJFord/terraform-provider-android/android/apk"
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
 	"mvdan.cc/fdroidcl/adb"
 )
 
@@ -20,6 +21,26 @@ func resourceAndroidApk() *schema.Resource {
 		Delete:      resourceAndroidApkDelete,
 
 		Schema: map[string]*schema.Schema{
+			"allowed_permissions": permissionsSchema("If set, the only permissions the APK may request, in addition to the provider's policy."),
+			"apk_sha256": {
+				Description: "Hex-encoded SHA-256 of the APKs to be installed, concatenated (for split APKs) in order of their file names.",
+				Computed:    true,
+				Type:        schema.TypeString,
+			},
+			"apk_size": {
+				Description: "Total size in bytes of the APKs to be installed.",
+				Computed:    true,
+				Type:        schema.TypeInt,
+			},
+			"command": {
+				Description: "Program and its arguments to run to acquire the APKs, speaking the JSON protocol described below. Required for the `exec` method.",
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Optional: true,
+				Type:     schema.TypeList,
+			},
+			"denied_permissions": permissionsSchema("Permissions the APK may not request, in addition to the provider's policy."),
 			"endpoint": {
 				Description: "IP:PORT of the device. Required for ADB over WiFi, omit for USB connections.",
 				Optional:    true,
@@ -30,18 +51,83 @@ func resourceAndroidApk() *schema.Resource {
 				},
 				Type: schema.TypeString,
 			},
+			"fdroid_repo": fdroidRepoSchema("F-Droid repositories to search, in order, instead of those configured on the provider."),
+			"forbidden_trackers": {
+				Description: "Names of trackers (as in `trackers`) which, if detected, fail the plan.",
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Optional: true,
+				Type:     schema.TypeList,
+			},
+			"installed_version": {
+				Description: "`versionCode` of the package currently installed on the device, or -1 if it isn't",
+				Computed:    true,
+				Type:        schema.TypeInt,
+			},
+			"label": {
+				Description: "Application label, i.e. its name as shown in the launcher.",
+				Computed:    true,
+				Type:        schema.TypeString,
+			},
+			"latest_available_version": {
+				Description: "`versionCode` of the newest version available from `method` (within any `version_constraint`), whether or not `update_policy` allows installing it",
+				Computed:    true,
+				Type:        schema.TypeInt,
+			},
+			"max_trackers": {
+				Default:     -1,
+				Description: "Maximum number of `trackers` which may be detected without failing the plan; -1 for no limit.",
+				Optional:    true,
+				Type:        schema.TypeInt,
+			},
 			"method": {
 				Default:     "aurora",
-				Description: "Method to use for acquiring the APK. (aurora, fdroid, gplaycli). `\"aurora\"` requires `com.aurora.store.debug`, currently a forked version, but which it can install to bootstrap itself. Aurora is required for multi-APK bundles, i.e. some apps will not work with gplaycli.",
+				Description: "Method to use for acquiring the APK. (aurora, device, exec, fdroid, gplaycli, local, url). `\"aurora\"` requires `com.aurora.store.debug`, currently a forked version, but which it can install to bootstrap itself. `\"gplaycli\"` downloads from Google Play directly, including split APKs (but not apps that need OBB expansion files), with the provider's `gplay_token` and `gplay_gsf_id`.",
 				Optional:    true,
 				Type:        schema.TypeString,
 			},
+			"methods": {
+				ConflictsWith: []string{"method"},
+				Description:   "Methods to use for acquiring the APK, as for `method`, tried in order until one has a version allowed by `version_constraint`, `version_name_pattern` and `signer_sha256`, e.g. `[\"fdroid\", \"aurora\"]`.",
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Optional: true,
+				Type:     schema.TypeList,
+			},
+			"min_sdk_version": {
+				Description: "`minSdkVersion` (API level) of the APK to be installed.",
+				Computed:    true,
+				Type:        schema.TypeInt,
+			},
 			"name": {
 				Description: "Qualified name of the package to install, e.g. `com.google.zxing.client.android`",
 				ForceNew:    true,
 				Required:    true,
 				Type:        schema.TypeString,
 			},
+			"native_abis": {
+				Description: "ABIs for which the APKs to be installed contain native libraries.",
+				Computed:    true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Type: schema.TypeList,
+			},
+			"path": {
+				Description: "Path to an APK, an Android App Bundle (`.aab`, see the provider's `bundle_signing_key`), a split APK bundle (`.apks`, `.xapk`, `.apkm`), a directory of split APKs, or a glob matching them. Required for the `local` method.",
+				Optional:    true,
+				Type:        schema.TypeString,
+			},
+			"permissions": {
+				Description: "Permissions requested (`uses-permission`) by the APK to be installed.",
+				Computed:    true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Type: schema.TypeList,
+			},
 			"serial": {
 				Description: "Serial number (`getprop ro.serialno`) of the device.",
 				ForceNew:    true,
@@ -53,24 +139,200 @@ func resourceAndroidApk() *schema.Resource {
 				},
 				Type: schema.TypeString,
 			},
+			"sha256": {
+				Description: "Hex-encoded SHA-256 of the file at `url`, which must match before it's cached. Required for the `url` method.",
+				Optional:    true,
+				RequiredWith: []string{
+					"url",
+				},
+				Type: schema.TypeString,
+			},
+			"signer": {
+				Description: "SHA-256 fingerprint of the certificate the APK to be installed is signed by.",
+				Computed:    true,
+				Type:        schema.TypeString,
+			},
+			"signer_sha256": {
+				Description: "SHA-256 fingerprints of the certificates the APKs may be signed by, e.g. several to allow for key rotation. If set, the APKs' signatures (v3, v2 or v1 scheme, as Android would check) are verified, and the plan and install fail if any is signed by another certificate.",
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Optional: true,
+				Type:     schema.TypeList,
+			},
+			"source_device": {
+				Description: "Reference device to copy the installed APKs from. Required for the `device` method.",
+				MaxItems:    1,
+				Optional:    true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"endpoint": {
+							Description: "IP:PORT of the source device. Required for ADB over WiFi, omit for USB connections.",
+							Optional:    true,
+							Type:        schema.TypeString,
+						},
+						"serial": {
+							Description: "Serial number (`getprop ro.serialno`) of the source device.",
+							Optional:    true,
+							Type:        schema.TypeString,
+						},
+					},
+				},
+				Type: schema.TypeList,
+			},
+			"supplied_by": {
+				Description: "Which of `methods` (or `method`) supplied the APK to be installed.",
+				Computed:    true,
+				Type:        schema.TypeString,
+			},
+			"target_sdk_version": {
+				Description: "`targetSdkVersion` (API level) of the APK to be installed.",
+				Computed:    true,
+				Type:        schema.TypeInt,
+			},
+			"target_version": {
+				Description: "With `update_policy = \"manual\"`, the `versionCode` to install. The package is only updated (or rolled back) when this changes.",
+				Optional:    true,
+				Type:        schema.TypeInt,
+			},
+			"trackers": {
+				Description: "Trackers detected, by the provider's `tracker_signatures`, in the classes of the APKs to be installed.",
+				Computed:    true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Type: schema.TypeList,
+			},
+			"update_policy": {
+				Default:     "always",
+				Description: "When to install a newer version than is installed. (always, manual, never). `\"manual\"` only changes version when `target_version` does; `\"never\"` only installs if the package is missing.",
+				Optional:    true,
+				Type:        schema.TypeString,
+				ValidateFunc: validation.StringInSlice([]string{
+					"always",
+					"manual",
+					"never",
+				}, false),
+			},
+			"url": {
+				Description: "HTTP(S) URL of an APK, an Android App Bundle (`.aab`), a split APK bundle (`.apks`, `.xapk`, `.apkm`), or a zip of split APKs. Required for the `url` method.",
+				Optional:    true,
+				RequiredWith: []string{
+					"sha256",
+				},
+				Type: schema.TypeString,
+			},
 			"version": {
-				Description: "Monotonically increasing `versionCode` of the package, safe for comparison",
+				Description: "Monotonically increasing `versionCode` of the package to be installed, safe for comparison",
 				Computed:    true,
 				Type:        schema.TypeInt,
 			},
+			"version_code": {
+				Description: "Exact `versionCode` to install, including older builds from the repo's archive, rather than the suggested version. Only supported by the `fdroid` method.",
+				Optional:    true,
+				Type:        schema.TypeInt,
+			},
+			"version_constraint": {
+				Description: "Comma-separated constraints on the `versionCode` to install, e.g. `>= 4100, < 4200`. Where the source offers a choice, the newest satisfying version is picked; otherwise the plan fails if what it provides doesn't satisfy them.",
+				Optional:    true,
+				Type:        schema.TypeString,
+			},
 			"version_name": {
 				Description: "Human-friendly `versionName`, defined by the package author and not guaranteed to increment",
 				Computed:    true,
 				Type:        schema.TypeString,
 			},
+			"version_name_pattern": {
+				Description: "Regular expression that the `versionName` to install must match, e.g. `^[0-9.]+$` to exclude betas. Applied like `version_constraint`.",
+				Optional:    true,
+				Type:        schema.TypeString,
+			},
 		},
 
 		CustomizeDiff: customiseDiff,
 	}
 }
 
+type resourceGetter interface {
+	Get(string) interface{}
+}
+
+// packageAcquirer makes the APKAcquirer configured by d. If planned, it's to install what was
+// planned: the method that supplied it is tried first if there are several, and the build is
+// that with the planned checksum.
+func packageAcquirer(d resourceGetter, m Meta, planned bool) (repo.APKAcquirer, error) {
+	fdroidRepos := expandFDroidRepos(d.Get("fdroid_repo"))
+	if len(fdroidRepos) == 0 {
+		fdroidRepos = m.fdroidRepos
+	}
+
+	// Not needed offline, when the APKs come from the cache
+	var sourceDevice *adb.Device
+	if source := d.Get("source_device").([]interface{}); len(source) > 0 && source[0] != nil && !m.offline {
+		source := source[0].(map[string]interface{})
+		device, err := findDeviceBySerialOrEndpoint(source["serial"].(string), source["endpoint"].(string), m)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to find source device: %s", err)
+		}
+		sourceDevice = device.Device
+	}
+
+	filter, err := repo.ParseVersionFilter(d.Get("version_constraint").(string), d.Get("version_name_pattern").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	var command []string
+	for _, arg := range d.Get("command").([]interface{}) {
+		command = append(command, arg.(string))
+	}
+
+	var signers []string
+	for _, signer := range d.Get("signer_sha256").([]interface{}) {
+		signers = append(signers, signer.(string))
+	}
+
+	methods := []string{d.Get("method").(string)}
+	if configured := d.Get("methods").([]interface{}); len(configured) > 0 {
+		methods = nil
+		for _, method := range configured {
+			methods = append(methods, method.(string))
+		}
+	}
+
+	var preferredMethod, plannedSha256, plannedSigner string
+	if planned {
+		preferredMethod = d.Get("supplied_by").(string)
+		plannedSha256 = d.Get("apk_sha256").(string)
+		plannedSigner = d.Get("signer").(string)
+	}
+
+	return repo.Package(methods, d.Get("name").(string), repo.Options{
+		Path:             d.Get("path").(string),
+		URL:              d.Get("url").(string),
+		Sha256:           d.Get("sha256").(string),
+		FDroidRepos:      fdroidRepos,
+		FDroidIndices:    m.fdroidIndices,
+		VersionCode:      d.Get("version_code").(int),
+		VersionFilter:    filter,
+		Signers:          signers,
+		SourceDevice:     sourceDevice,
+		BundleSigningKey: m.bundleSigningKey,
+		GPlay:            m.gplay,
+		Command:          command,
+		PreferredMethod:  preferredMethod,
+		PlannedSha256:    plannedSha256,
+		PlannedSigner:    plannedSigner,
+		Offline:          m.offline,
+		CacheLimits:      m.cacheLimits,
+		RefreshInterval:  m.refreshInterval,
+		ExecTimeout:      m.execTimeout,
+		AuroraTimeouts:   m.auroraTimeouts,
+	})
+}
+
 func customiseDiff(d *schema.ResourceDiff, m interface{}) error {
-	apk, err := repo.Package(d.Get("method").(string), d.Get("name").(string))
+	apk, err := packageAcquirer(d, m.(Meta), false)
 	if err != nil {
 		return err
 	}
@@ -90,15 +352,54 @@ func customiseDiff(d *schema.ResourceDiff, m interface{}) error {
 		return err
 	}
 
+	policy := d.Get("update_policy").(string)
+	installed := d.Get("installed_version").(int)
+	isInstalled := d.Id() != "" && installed > 0
+
+	target := d.Get("target_version").(int)
+	pinTarget := policy == "manual" && target > 0 && (!isInstalled || d.HasChange("target_version"))
+	if pinTarget {
+		apk.Apk().VersionFilter = apk.Apk().VersionFilter.WithVersionCode(target)
+	}
+
 	if err = apk.UpdateCache(device.Device); err != nil {
 		return err
 	}
 
-	v, err := repo.Version(apk)
+	if err = repo.CheckVersion(apk); err != nil {
+		return err
+	}
+
+	if err = repo.CheckSigner(apk); err != nil {
+		return err
+	}
+
+	latest, err := repo.Version(apk)
 	if err != nil {
 		return err
 	}
 
+	if err = d.SetNew("latest_available_version", latest); err != nil {
+		return err
+	}
+
+	v := latest
+	switch policy {
+	case "manual":
+		if isInstalled && !pinTarget {
+			v = installed
+		}
+	case "never":
+		if isInstalled {
+			v = installed
+		}
+	}
+
+	if v != latest {
+		log.Printf("[INFO] Not updating %s from %d to %d, policy is %s", d.Get("name").(string), installed, latest, policy)
+		return nil
+	}
+
 	err = d.SetNew("version", v)
 	if err != nil {
 		return err
@@ -109,6 +410,12 @@ func customiseDiff(d *schema.ResourceDiff, m interface{}) error {
 		d.ForceNew("version")
 	}
 
+	if vold.(int) != vnew.(int) {
+		if err = d.SetNewComputed("installed_version"); err != nil {
+			return err
+		}
+	}
+
 	vn, err := repo.VersionName(apk)
 	if err != nil {
 		return err
@@ -119,6 +426,51 @@ func customiseDiff(d *schema.ResourceDiff, m interface{}) error {
 		return err
 	}
 
+	meta, err := repo.ReadMetadata(apk)
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range []repo.PermissionPolicy{m.(Meta).permissionPolicy, expandPermissionPolicy(d)} {
+		if err = policy.Check(d.Get("name").(string), meta.Permissions); err != nil {
+			return err
+		}
+	}
+
+	trackers, err := repo.DetectTrackers(apk, m.(Meta).trackerDB)
+	if err != nil {
+		return err
+	}
+
+	if max := d.Get("max_trackers").(int); max >= 0 && len(trackers) > max {
+		return fmt.Errorf("%s contains %d trackers, more than max_trackers %d: %s", d.Get("name").(string), len(trackers), max, strings.Join(trackers, ", "))
+	}
+
+	for _, forbidden := range d.Get("forbidden_trackers").([]interface{}) {
+		for _, tracker := range trackers {
+			if strings.EqualFold(tracker, forbidden.(string)) {
+				return fmt.Errorf("%s contains forbidden tracker %s", d.Get("name").(string), tracker)
+			}
+		}
+	}
+
+	for k, v := range map[string]interface{}{
+		"apk_sha256":         meta.Sha256,
+		"apk_size":           int(meta.Size),
+		"label":              meta.Label,
+		"min_sdk_version":    meta.MinSdkVersion,
+		"native_abis":        meta.NativeABIs,
+		"permissions":        meta.Permissions,
+		"signer":             meta.SignerSha256,
+		"supplied_by":        apk.Apk().Method,
+		"target_sdk_version": meta.TargetSdkVersion,
+		"trackers":           trackers,
+	} {
+		if err = d.SetNew(k, v); err != nil {
+			return err
+		}
+	}
+
 	log.Printf("[DEBUG] Diff complete for %s @ %d", d.Get("name").(string), v)
 	return nil
 }
@@ -247,6 +599,34 @@ func installApk(device *adb.Device, version int, apk repo.APKAcquirer) error {
 		return err
 	}
 
+	// Not all methods can be asked for a particular version, and what they have may have
+	// changed since the plan
+	got, err := repo.Version(apk)
+	if err != nil {
+		return err
+	}
+	if got != version {
+		return fmt.Errorf("Planned to install %s @ %d, but got %d: plan again", apk.Apk().Name, version, got)
+	}
+
+	if err = repo.CheckVersion(apk); err != nil {
+		return err
+	}
+
+	if err = repo.CheckSigner(apk); err != nil {
+		return err
+	}
+
+	props, err := device.AdbProps()
+	if err != nil {
+		return fmt.Errorf("Failed to read properties of %s: %s", device.Model, err)
+	}
+
+	apkPaths, err = repo.SelectSplits(apkPaths, repo.DeviceSpecFromProps(props))
+	if err != nil {
+		return fmt.Errorf("Failed to install %s to %s: %s", apk.Apk().Name, device.Model, err)
+	}
+
 	log.Printf("[DEBUG] Installing %s", apk.Apk().Name)
 	if err := installMultiple(device, apkPaths); err != nil {
 		return fmt.Errorf("Failed to install %s to %s: %s", apk.Apk().Name, device.Model, err)
@@ -273,7 +653,8 @@ func resourceAndroidApkCreate(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
-	apkAcquirer, err := repo.Package(d.Get("method").(string), pkg)
+	// Install from where the version was planned, if it's still available there
+	apkAcquirer, err := packageAcquirer(d, m.(Meta), true)
 	if err != nil {
 		return err
 	}
@@ -320,6 +701,7 @@ func resourceAndroidApkRead(d *schema.ResourceData, m interface{}) error {
 	if ipkg, ok := installed[pkg]; ok {
 		log.Printf("[INFO] %s installed at version %s (%d)", ipkg.ID, ipkg.VersName, ipkg.VersCode)
 		d.SetId(fmt.Sprint(serial, "-", pkg))
+		d.Set("installed_version", ipkg.VersCode)
 		d.Set("version", ipkg.VersCode)
 		d.Set("version_name", ipkg.VersName)
 		return nil
@@ -327,6 +709,7 @@ func resourceAndroidApkRead(d *schema.ResourceData, m interface{}) error {
 
 	log.Printf("[INFO] %s not installed", pkg)
 	d.SetId("")
+	d.Set("installed_version", -1)
 	d.Set("version", -1)
 	d.Set("version_name", "Not installed")
 	return nil
@@ -341,7 +724,13 @@ func resourceAndroidApkUpdate(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
-	apkAcquirer, err := repo.Package(d.Get("method").(string), pkg)
+	if !d.HasChange("version") {
+		log.Printf("[DEBUG] Not reinstalling %s, version unchanged", pkg)
+		return resourceAndroidApkRead(d, m)
+	}
+
+	// Install from where the version was planned, if it's still available there
+	apkAcquirer, err := packageAcquirer(d, m.(Meta), true)
 	if err != nil {
 		return err
 	}
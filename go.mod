@@ -6,5 +6,7 @@ require (
 	github.com/adrg/xdg v0.2.3
 	github.com/hashicorp/terraform-plugin-sdk v1.16.0
 	github.com/shogo82148/androidbinary v1.0.2
+	go.mozilla.org/pkcs7 v0.10.0
+	google.golang.org/protobuf v1.25.0
 	mvdan.cc/fdroidcl v0.5.0
 )